@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// isSupportedArchive reports whether the given file is a .tar.gz, .tgz or .zip archive.
+func isSupportedArchive(pth string) bool {
+	lower := strings.ToLower(pth)
+	return strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") || strings.HasSuffix(lower, ".zip")
+}
+
+// extractPackagesArchive extracts the given .tar.gz or .zip archive into the target directory
+// and returns the number of extracted files.
+func extractPackagesArchive(archivePth, targetDir string) (int, error) {
+	if info, err := os.Stat(archivePth); err != nil {
+		return 0, fmt.Errorf("failed to stat archive (%s): %s", archivePth, err)
+	} else if info.IsDir() {
+		return 0, fmt.Errorf("archive (%s) is a directory", archivePth)
+	}
+	if !isSupportedArchive(archivePth) {
+		return 0, fmt.Errorf("archive (%s) must be a .tar.gz, .tgz or .zip file", archivePth)
+	}
+
+	absTargetDir, err := filepath.Abs(targetDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to determine target path: %s", err)
+	}
+	if info, err := os.Stat(absTargetDir); err == nil && !info.IsDir() {
+		return 0, fmt.Errorf("target (%s) is not a directory", absTargetDir)
+	}
+	if err := os.MkdirAll(absTargetDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create target (%s): %s", absTargetDir, err)
+	}
+
+	if strings.HasSuffix(strings.ToLower(archivePth), ".zip") {
+		return extractZip(archivePth, absTargetDir)
+	}
+	return extractTarGz(archivePth, absTargetDir)
+}
+
+// archiveEntryPath returns the path of an archive entry under the target directory.
+// Entries pointing outside of the target directory are rejected.
+func archiveEntryPath(targetDir, name string) (string, error) {
+	pth := filepath.Join(targetDir, filepath.FromSlash(name))
+	if pth != targetDir && !isSubPath(targetDir, pth) {
+		return "", fmt.Errorf("archive entry (%s) points outside of the target directory", name)
+	}
+	return pth, nil
+}
+
+// writeArchiveFile writes the content of an archive entry to the given path.
+func writeArchiveFile(pth string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return fmt.Errorf("failed to create (%s): %s", filepath.Dir(pth), err)
+	}
+
+	f, err := os.OpenFile(pth, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return fmt.Errorf("failed to create (%s): %s", pth, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write (%s): %s", pth, err)
+	}
+	return f.Close()
+}
+
+func extractTarGz(archivePth, targetDir string) (int, error) {
+	f, err := os.Open(archivePth)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open (%s): %s", archivePth, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close (%s)", archivePth)
+		}
+	}()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gzip archive (%s): %s", archivePth, err)
+	}
+
+	count := 0
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return count, fmt.Errorf("invalid tar archive (%s): %s", archivePth, err)
+		}
+
+		pth, err := archiveEntryPath(targetDir, header.Name)
+		if err != nil {
+			return count, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(pth, 0755); err != nil {
+				return count, fmt.Errorf("failed to create (%s): %s", pth, err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeArchiveFile(pth, os.FileMode(header.Mode), tr); err != nil {
+				return count, err
+			}
+			count++
+		default:
+			log.Warnf("Skipping unsupported archive entry: %s", header.Name)
+		}
+	}
+	return count, nil
+}
+
+func extractZip(archivePth, targetDir string) (int, error) {
+	zr, err := zip.OpenReader(archivePth)
+	if err != nil {
+		return 0, fmt.Errorf("invalid zip archive (%s): %s", archivePth, err)
+	}
+	defer func() {
+		if err := zr.Close(); err != nil {
+			log.Warnf("Failed to close (%s)", archivePth)
+		}
+	}()
+
+	count := 0
+	for _, file := range zr.File {
+		pth, err := archiveEntryPath(targetDir, file.Name)
+		if err != nil {
+			return count, err
+		}
+
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(pth, 0755); err != nil {
+				return count, fmt.Errorf("failed to create (%s): %s", pth, err)
+			}
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return count, fmt.Errorf("failed to open archive entry (%s): %s", file.Name, err)
+		}
+		err = writeArchiveFile(pth, file.Mode(), rc)
+		if cerr := rc.Close(); err == nil && cerr != nil {
+			err = cerr
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
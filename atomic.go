@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// stagedDir is a packages folder restored into a temporary sibling directory,
+// which replaces the real folder only after a successful restore.
+type stagedDir struct {
+	target  string
+	staging string
+}
+
+// stageDir creates the staging sibling of the given directory, prefilled with the current content of the directory.
+// The files are hard linked where possible, NuGet never modifies an extracted package in place.
+func stageDir(target string) (stagedDir, error) {
+	d := stagedDir{target: target, staging: target + ".staging"}
+	if err := os.RemoveAll(d.staging); err != nil {
+		return stagedDir{}, fmt.Errorf("failed to remove stale staging dir (%s): %s", d.staging, err)
+	}
+
+	if exist, err := pathutil.IsDirExists(target); err != nil {
+		return stagedDir{}, fmt.Errorf("failed to check (%s): %s", target, err)
+	} else if !exist {
+		if err := os.MkdirAll(d.staging, 0755); err != nil {
+			return stagedDir{}, fmt.Errorf("failed to create staging dir (%s): %s", d.staging, err)
+		}
+		return d, nil
+	}
+
+	if err := linkTree(target, d.staging); err != nil {
+		d.discard()
+		return stagedDir{}, fmt.Errorf("failed to prefill staging dir (%s): %s", d.staging, err)
+	}
+	return d, nil
+}
+
+// commit swaps the staging directory into the place of the target directory.
+// The previous target is kept until the swap succeeds, so it is restored if the second rename fails.
+func (d stagedDir) commit() error {
+	previous := d.target + ".previous"
+	if err := os.RemoveAll(previous); err != nil {
+		return fmt.Errorf("failed to remove (%s): %s", previous, err)
+	}
+
+	exist, err := pathutil.IsDirExists(d.target)
+	if err != nil {
+		return fmt.Errorf("failed to check (%s): %s", d.target, err)
+	}
+	if exist {
+		if err := os.Rename(d.target, previous); err != nil {
+			return fmt.Errorf("failed to move (%s) aside: %s", d.target, err)
+		}
+	}
+	if err := os.Rename(d.staging, d.target); err != nil {
+		if exist {
+			if rerr := os.Rename(previous, d.target); rerr != nil {
+				log.Warnf("Failed to move back (%s): %s", d.target, rerr)
+			}
+		}
+		return fmt.Errorf("failed to move (%s) into place: %s", d.staging, err)
+	}
+
+	if exist {
+		if err := os.RemoveAll(previous); err != nil {
+			log.Warnf("Failed to remove (%s): %s", previous, err)
+		}
+	}
+	return nil
+}
+
+// discard removes the staging directory, the target directory is left untouched.
+func (d stagedDir) discard() {
+	if err := os.RemoveAll(d.staging); err != nil {
+		log.Warnf("Failed to remove staging dir (%s): %s", d.staging, err)
+	}
+}
+
+// linkTree recreates the source directory tree in the target directory, hard linking the files and falling back to copying them.
+func linkTree(sourceDir, targetDir string) error {
+	return filepath.Walk(sourceDir, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(sourceDir, pth)
+		if err != nil {
+			return err
+		}
+		targetPth := filepath.Join(targetDir, rel)
+
+		switch {
+		case f.IsDir():
+			return os.MkdirAll(targetPth, f.Mode().Perm()|0700)
+		case f.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(pth)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, targetPth)
+		}
+
+		if err := os.Link(pth, targetPth); err == nil {
+			return nil
+		}
+		return copyFile(pth, targetPth, f.Mode())
+	})
+}
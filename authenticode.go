@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// signerSubjectPattern matches the subject of the leaf signer certificate in the osslsigncode verify output:
+// "Signer's certificate:" is printed by osslsigncode 1.x, "Signer #0:" by 2.x.
+var signerSubjectPattern = regexp.MustCompile(`(?s)Signer(?:'s certificate:| #0:).*?Subject:\s*([^\n]+)`)
+
+// signerSerialPattern matches the serial number of the leaf signer certificate in the osslsigncode verify output.
+var signerSerialPattern = regexp.MustCompile(`(?s)Signer(?:'s certificate:| #0:).*?Serial\s*:\s*([0-9A-Fa-f:]+)`)
+
+// thumbprintSeparators are stripped from the configured thumbprint, as it is often copied with colons or spaces.
+var thumbprintSeparators = strings.NewReplacer(":", "", " ", "")
+
+// authenticodeSigner is the signer certificate of an Authenticode signature.
+type authenticodeSigner struct {
+	subject string
+	serial  string
+}
+
+// parseAuthenticodeSigner returns the subject and the serial number of the signer certificate from the osslsigncode verify output.
+func parseAuthenticodeSigner(output string) (authenticodeSigner, bool) {
+	match := signerSubjectPattern.FindStringSubmatch(output)
+	if len(match) < 2 {
+		return authenticodeSigner{}, false
+	}
+	signer := authenticodeSigner{subject: strings.TrimSpace(match[1])}
+	if match := signerSerialPattern.FindStringSubmatch(output); len(match) == 2 {
+		signer.serial = match[1]
+	}
+	return signer, true
+}
+
+// subjectAttributes parses the attributes of a certificate subject, printed either as /C=US/O=Org/CN=Name (OpenSSL 1.x)
+// or as C=US, O=Org, CN=Name (OpenSSL 3).
+func subjectAttributes(subject string) map[string]string {
+	separator := ", "
+	if strings.HasPrefix(subject, "/") {
+		separator = "/"
+	}
+
+	attributes := map[string]string{}
+	for _, part := range strings.Split(subject, separator) {
+		split := strings.SplitN(part, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		attributes[strings.ToUpper(strings.TrimSpace(split[0]))] = strings.TrimSpace(split[1])
+	}
+	return attributes
+}
+
+// matchesSigner reports whether the common name or the organization of the subject is exactly the expected signer.
+func matchesSigner(subject, expectedSigner string) bool {
+	attributes := subjectAttributes(subject)
+	return attributes["CN"] == expectedSigner || attributes["O"] == expectedSigner
+}
+
+// normalizeThumbprint returns the lower cased hex thumbprint without separators.
+func normalizeThumbprint(thumbprint string) string {
+	return strings.ToLower(thumbprintSeparators.Replace(strings.TrimSpace(thumbprint)))
+}
+
+// validateThumbprint checks whether the given thumbprint is a hex encoded SHA-1 or SHA-256 certificate hash.
+func validateThumbprint(thumbprint string) error {
+	normalized := normalizeThumbprint(thumbprint)
+	if _, err := hex.DecodeString(normalized); err != nil || (len(normalized) != 40 && len(normalized) != 64) {
+		return fmt.Errorf("thumbprint (%s) is not a hex encoded SHA-1 or SHA-256 certificate hash", thumbprint)
+	}
+	return nil
+}
+
+// certificateThumbprint returns the hex encoded SHA-1 or SHA-256 hash of the certificate, matching the length of the expected thumbprint.
+func certificateThumbprint(cert *x509.Certificate, expected string) string {
+	if len(expected) == 64 {
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	}
+	sum := sha1.Sum(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// sameSerial reports whether the serial number printed by osslsigncode is the serial number of the certificate.
+func sameSerial(printed string, cert *x509.Certificate) bool {
+	printed = strings.TrimLeft(strings.ToLower(strings.Replace(printed, ":", "", -1)), "0")
+	return printed == strings.TrimLeft(cert.SerialNumber.Text(16), "0")
+}
+
+// verifyAuthenticode verifies the Authenticode signature of the given PE file with osslsigncode,
+// and checks that the common name or the organization of the signer certificate is exactly the expected signer (like Microsoft Corporation).
+// If the thumbprint is set, the signer certificate is pinned to it as well.
+func verifyAuthenticode(pth, expectedSigner, thumbprint string) error {
+	osslsigncodePth, err := exec.LookPath("osslsigncode")
+	if err != nil {
+		return fmt.Errorf("osslsigncode is required to verify the Authenticode signature, install it with brew install osslsigncode: %s", err)
+	}
+
+	cmd := command.New(osslsigncodePth, "verify", "-in", pth)
+	log.Donef("$ %s", cmd.PrintableCommandArgs())
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return fmt.Errorf("the Authenticode signature of (%s) is missing or invalid: %s, output: %s", pth, err, out)
+	}
+
+	signer, ok := parseAuthenticodeSigner(out)
+	if !ok {
+		return fmt.Errorf("no signer certificate found in the osslsigncode output: %s", out)
+	}
+	if !matchesSigner(signer.subject, expectedSigner) {
+		return fmt.Errorf("(%s) is signed by %s, expected signer: %s", pth, signer.subject, expectedSigner)
+	}
+	if thumbprint != "" {
+		if err := verifySignerThumbprint(osslsigncodePth, pth, signer, normalizeThumbprint(thumbprint)); err != nil {
+			return err
+		}
+	}
+	log.Printf("Authenticode signature verified, signer: %s", signer.subject)
+	return nil
+}
+
+// verifySignerThumbprint extracts the certificates of the signature and checks the thumbprint of the signer certificate,
+// which is identified by its serial number, as the signature may contain further certificates.
+func verifySignerThumbprint(osslsigncodePth, pth string, signer authenticodeSigner, thumbprint string) error {
+	if signer.serial == "" {
+		return fmt.Errorf("no signer serial number found in the osslsigncode output, the thumbprint can not be verified")
+	}
+	opensslPth, err := exec.LookPath("openssl")
+	if err != nil {
+		return fmt.Errorf("openssl is required to verify the signer thumbprint: %s", err)
+	}
+
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("__authenticode__")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp dir: %s", err)
+	}
+	signaturePth := filepath.Join(tmpDir, "signature.pem")
+
+	extractCmd := command.New(osslsigncodePth, "extract-signature", "-pem", "-in", pth, "-out", signaturePth)
+	log.Donef("$ %s", extractCmd.PrintableCommandArgs())
+	if out, err := extractCmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return fmt.Errorf("failed to extract the signature of (%s): %s, output: %s", pth, err, out)
+	}
+
+	printCmd := command.New(opensslPth, "pkcs7", "-in", signaturePth, "-print_certs")
+	log.Donef("$ %s", printCmd.PrintableCommandArgs())
+	out, err := printCmd.RunAndReturnTrimmedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to read the certificates of the signature: %s, output: %s", err, out)
+	}
+
+	rest := []byte(out)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || !sameSerial(signer.serial, cert) {
+			continue
+		}
+		if actual := certificateThumbprint(cert, thumbprint); actual != thumbprint {
+			return fmt.Errorf("the signer certificate of (%s) has thumbprint %s, expected: %s", pth, actual, thumbprint)
+		}
+		log.Printf("Signer certificate thumbprint verified: %s", thumbprint)
+		return nil
+	}
+	return fmt.Errorf("the signer certificate (serial: %s) is not found in the signature of (%s)", signer.serial, pth)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAuthenticodeSigner(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   authenticodeSigner
+		wantOK bool
+	}{
+		{
+			name: "osslsigncode 1.x",
+			output: `Signature verification: ok
+
+Number of signers: 1
+	Signer #0:
+		Subject: /C=US/ST=Washington/L=Redmond/O=Microsoft Corporation/CN=Microsoft Corporation
+		Issuer : /C=US/ST=Washington/L=Redmond/O=Microsoft Corporation/CN=Microsoft Code Signing PCA 2011
+		Serial : 33000002CF6E9DC7D23CE3A0E70000000002CF
+`,
+			want: authenticodeSigner{
+				subject: "/C=US/ST=Washington/L=Redmond/O=Microsoft Corporation/CN=Microsoft Corporation",
+				serial:  "33000002CF6E9DC7D23CE3A0E70000000002CF",
+			},
+			wantOK: true,
+		},
+		{
+			name: "osslsigncode 2.x",
+			output: `Signer's certificate:
+	Signer #0:
+		Subject: C=US, ST=Washington, L=Redmond, O=Microsoft Corporation, CN=Microsoft Corporation
+		Issuer: C=US, ST=Washington, L=Redmond, O=Microsoft Corporation, CN=Microsoft Code Signing PCA 2011
+		Serial : 33:00:00:02:CF
+`,
+			want: authenticodeSigner{
+				subject: "C=US, ST=Washington, L=Redmond, O=Microsoft Corporation, CN=Microsoft Corporation",
+				serial:  "33:00:00:02:CF",
+			},
+			wantOK: true,
+		},
+		{
+			name:   "unsigned",
+			output: "No signature found.",
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseAuthenticodeSigner(tt.output)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("parseAuthenticodeSigner() = %+v, %t, want %+v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMatchesSigner(t *testing.T) {
+	tests := []struct {
+		name     string
+		subject  string
+		expected string
+		want     bool
+	}{
+		{
+			name:     "common name",
+			subject:  "/C=US/O=Microsoft Corporation/CN=Microsoft Corporation",
+			expected: "Microsoft Corporation",
+			want:     true,
+		},
+		{
+			name:     "organization",
+			subject:  "C=US, O=Microsoft Corporation, CN=Microsoft Code Signing",
+			expected: "Microsoft Corporation",
+			want:     true,
+		},
+		{
+			name:     "substring of the common name",
+			subject:  "/C=US/O=Microsoft Corporation/CN=Microsoft Corporation",
+			expected: "Microsoft",
+			want:     false,
+		},
+		{
+			name:     "expected signer in another attribute",
+			subject:  "C=US, L=Microsoft Corporation, O=Evil Inc, CN=Evil Inc",
+			expected: "Microsoft Corporation",
+			want:     false,
+		},
+		{
+			name:     "expected signer as a prefix",
+			subject:  "/C=US/O=Microsoft Corporation Fake/CN=Microsoft Corporation Fake",
+			expected: "Microsoft Corporation",
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesSigner(tt.subject, tt.expected); got != tt.want {
+				t.Errorf("matchesSigner(%q, %q) = %t, want %t", tt.subject, tt.expected, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateThumbprint(t *testing.T) {
+	tests := []struct {
+		thumbprint string
+		wantErr    bool
+	}{
+		{thumbprint: "3CAF9BA4F8C4F35C8B8FA1DCAF4EE4AFAF8C6D7E", wantErr: false},
+		{thumbprint: "3c:af:9b:a4:f8:c4:f3:5c:8b:8f:a1:dc:af:4e:e4:af:af:8c:6d:7e", wantErr: false},
+		{thumbprint: strings.Repeat("ab", 32), wantErr: false},
+		{thumbprint: "3CAF9BA4", wantErr: true},
+		{thumbprint: strings.Repeat("zz", 20), wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateThumbprint(tt.thumbprint); (err != nil) != tt.wantErr {
+			t.Errorf("validateThumbprint(%q) error = %v, wantErr %t", tt.thumbprint, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSignerCertificateThumbprint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0x0102AB),
+		Subject:      pkix.Name{CommonName: "Test Signer"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, serial := range []string{"0102AB", "00:01:02:ab", "102ab"} {
+		if !sameSerial(serial, cert) {
+			t.Errorf("sameSerial(%q) = false, want true", serial)
+		}
+	}
+	if sameSerial("0102AC", cert) {
+		t.Errorf("sameSerial(0102AC) = true, want false")
+	}
+
+	sum := sha1.Sum(der)
+	sha1Thumbprint := hex.EncodeToString(sum[:])
+	if got := certificateThumbprint(cert, normalizeThumbprint(strings.ToUpper(sha1Thumbprint))); got != sha1Thumbprint {
+		t.Errorf("certificateThumbprint() = %s, want %s", got, sha1Thumbprint)
+	}
+	if got := certificateThumbprint(cert, strings.Repeat("0", 64)); len(got) != 64 {
+		t.Errorf("certificateThumbprint() = %s, want a SHA-256 thumbprint", got)
+	}
+}
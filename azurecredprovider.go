@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	azureCredentialProviderURL = "https://github.com/microsoft/artifacts-credprovider/releases/latest/download/Microsoft.NuGet.CredentialProvider.tar.gz"
+	vssFeedEndpointsEnv        = "VSS_NUGET_EXTERNAL_FEED_ENDPOINTS"
+)
+
+// feedEndpointCredential is an entry of the VSS_NUGET_EXTERNAL_FEED_ENDPOINTS JSON.
+type feedEndpointCredential struct {
+	Endpoint string `json:"endpoint"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// validateFeedEndpoints checks the VSS_NUGET_EXTERNAL_FEED_ENDPOINTS JSON read by the Azure Artifacts credential provider.
+func validateFeedEndpoints(content string) error {
+	var endpoints struct {
+		EndpointCredentials []feedEndpointCredential `json:"endpointCredentials"`
+	}
+	if err := json.NewDecoder(strings.NewReader(content)).Decode(&endpoints); err != nil {
+		// The decoder error never contains the values of the JSON, so the secrets are not leaked.
+		return fmt.Errorf("invalid feed endpoints JSON, expected {\"endpointCredentials\": [{\"endpoint\": \"...\", \"password\": \"...\"}]}: %s", err)
+	}
+	if len(endpoints.EndpointCredentials) == 0 {
+		return fmt.Errorf("feed endpoints JSON has no endpointCredentials")
+	}
+	for _, endpoint := range endpoints.EndpointCredentials {
+		if err := validateSourceURL(endpoint.Endpoint); err != nil {
+			return err
+		}
+		if endpoint.Password == "" {
+			return fmt.Errorf("feed endpoint (%s) has no password", endpoint.Endpoint)
+		}
+	}
+	return nil
+}
+
+// installAzureCredentialProvider downloads the latest Azure Artifacts credential provider
+// and extracts it into ~/.nuget/plugins, where nuget.exe, dotnet and msbuild discover it.
+// It returns the plugins directory.
+func installAzureCredentialProvider(client httpDoer, credentials netrc) (string, error) {
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("__credprovider__")
+	if err != nil {
+		return "", fmt.Errorf("failed to create tmp dir: %s", err)
+	}
+	archivePth := filepath.Join(tmpDir, "Microsoft.NuGet.CredentialProvider.tar.gz")
+
+	log.Printf("Download URL: %s", azureCredentialProviderURL)
+	if err := downloadFile(client, azureCredentialProviderURL, archivePth, credentials); err != nil {
+		return "", fmt.Errorf("failed to download the credential provider: %s", err)
+	}
+
+	// The archive contains the plugins/netfx and plugins/netcore directories.
+	nuGetDir := filepath.Join(pathutil.UserHomeDir(), ".nuget")
+	count, err := extractPackagesArchive(archivePth, nuGetDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract the credential provider: %s", err)
+	}
+	pluginsDir := filepath.Join(nuGetDir, "plugins")
+	log.Printf("Extracted %d files into %s", count, pluginsDir)
+	return pluginsDir, nil
+}
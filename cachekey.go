@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// cacheIndicatorFileName is the file holding the dependency hash, written to the temp dir so it is never cached itself.
+const cacheIndicatorFileName = "bitrise-nuget-cache-indicator"
+
+// collectDependencyFiles returns the packages.config and packages.lock.json files under the given base paths, sorted.
+// The packages folders are not searched, they hold restored packages, not dependency declarations.
+func collectDependencyFiles(basePths []string) ([]string, error) {
+	seen := map[string]bool{}
+	var files []string
+	for _, basePth := range basePths {
+		absBasePth, err := filepath.Abs(basePth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine absolute path of (%s): %s", basePth, err)
+		}
+		if err := filepath.Walk(absBasePth, func(pth string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if f.IsDir() {
+				if f.Name() == "packages" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if (f.Name() == packagesConfigFile || f.Name() == nuGetLockFile) && !seen[pth] {
+				seen[pth] = true
+				files = append(files, pth)
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to collect dependency files: %s", err)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// dependencyHash returns the hex encoded SHA-256 hash of the paths and contents of the given files.
+// The paths are hashed relative to the given root, so the hash does not depend on the checkout directory.
+func dependencyHash(root string, files []string) (string, error) {
+	hash := sha256.New()
+	for _, pth := range files {
+		rel, err := filepath.Rel(root, pth)
+		if err != nil {
+			rel = pth
+		}
+		content, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return "", fmt.Errorf("failed to read (%s): %s", pth, err)
+		}
+		fmt.Fprintf(hash, "%s\n%d\n", filepath.ToSlash(rel), len(content))
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeCacheIndicator writes the hash of the dependency files under the given base paths to the cache indicator file,
+// and returns its path. The returned path is empty if there is no dependency file.
+func writeCacheIndicator(basePths []string) (string, error) {
+	files, err := collectDependencyFiles(basePths)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", nil
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine working directory: %s", err)
+	}
+	hash, err := dependencyHash(root, files)
+	if err != nil {
+		return "", err
+	}
+
+	pth := filepath.Join(os.TempDir(), cacheIndicatorFileName)
+	if err := ioutil.WriteFile(pth, []byte(hash+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write (%s): %s", pth, err)
+	}
+	return pth, nil
+}
+
+// withIndicator returns the cache include path of the given path, which is invalidated when the indicator file changes.
+// The cache step reads the "<path> -> <indicator file>" format: the path is only re-cached if the content of the indicator changed.
+func withIndicator(pth, indicator string) string {
+	if indicator == "" {
+		return pth
+	}
+	return pth + " -> " + indicator
+}
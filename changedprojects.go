@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// slnProjectPattern matches the project entries of a .sln file, capturing the project path relative to the solution:
+// Project("{type GUID}") = "Name", "path\to\Project.csproj", "{project GUID}"
+var slnProjectPattern = regexp.MustCompile(`(?m)^Project\("\{[^}]+\}"\)\s*=\s*"[^"]*"\s*,\s*"([^"]+)"`)
+
+// solutionWideFiles are the files (lower cased) which affect the restore of every project, a change to one of them needs a full restore.
+var solutionWideFiles = []string{"nuget.config", "directory.build.props", "directory.build.targets", "directory.packages.props", "global.json", paketDependenciesFile}
+
+// restoreTarget is a solution or a project restored by the step.
+type restoreTarget struct {
+	path string
+	// solutionDir is the directory of the solution the project belongs to, empty for a solution.
+	solutionDir string
+}
+
+// configs returns the given configs with the target set as the restored solution.
+// The packages.config projects of a solution are restored into the solution's packages folder, unless solution_directory is set.
+func (t restoreTarget) configs(configs ConfigsModel) ConfigsModel {
+	configs.XamarinSolution = t.path
+	if t.solutionDir != "" && configs.SolutionDirectory == "" {
+		configs.SolutionDirectory = t.solutionDir
+	}
+	return configs
+}
+
+// parseChangedFiles parses the newline separated changed_files input into absolute paths.
+func parseChangedFiles(list string) ([]string, error) {
+	var files []string
+	for _, line := range strings.Split(list, "\n") {
+		pth := strings.TrimSpace(line)
+		if pth == "" {
+			continue
+		}
+		absPth, err := filepath.Abs(pth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine absolute path of changed file (%s): %s", pth, err)
+		}
+		files = append(files, absPth)
+	}
+	return files, nil
+}
+
+// parseSolutionProjects returns the absolute paths of the restorable projects listed in the given .sln file.
+// Solution folders and other non restorable entries are skipped.
+func parseSolutionProjects(solution string, exts []string) ([]string, error) {
+	content, err := ioutil.ReadFile(solution)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read solution (%s): %s", solution, err)
+	}
+	absSolutionDir, err := filepath.Abs(filepath.Dir(solution))
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine absolute path of (%s): %s", solution, err)
+	}
+
+	var projects []string
+	for _, match := range slnProjectPattern.FindAllStringSubmatch(string(content), -1) {
+		rel := filepath.FromSlash(strings.Replace(match[1], `\`, "/", -1))
+		if isRestorable(rel, exts) {
+			projects = append(projects, filepath.Join(absSolutionDir, rel))
+		}
+	}
+	return projects, nil
+}
+
+// changedProjects returns the projects of the given .sln solution owning any of the changed files, in the order of the solution.
+// A file belongs to the project with the deepest directory containing it, files outside of the solution's directory are ignored.
+// The second return value is false if the solution has to be restored entirely: if no project could be mapped,
+// or a solution wide file (like the solution itself or a NuGet.config) changed.
+func changedProjects(solution string, changedFiles []string, exts []string) ([]string, bool, error) {
+	if !strings.EqualFold(filepath.Ext(solution), ".sln") {
+		return nil, false, nil
+	}
+	projects, err := parseSolutionProjects(solution, exts)
+	if err != nil {
+		return nil, false, err
+	}
+	absSolution, err := filepath.Abs(solution)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to determine absolute path of (%s): %s", solution, err)
+	}
+	absSolutionDir := filepath.Dir(absSolution)
+
+	changed := map[string]bool{}
+	for _, file := range changedFiles {
+		if file == absSolution || (isSolutionWideFile(file) && isSubPath(absSolutionDir, file)) {
+			return nil, false, nil
+		}
+
+		owner := ""
+		for _, project := range projects {
+			projectDir := filepath.Dir(project)
+			if (file == project || isSubPath(projectDir, file)) && len(projectDir) > len(filepath.Dir(owner)) {
+				owner = project
+			}
+		}
+		if owner != "" {
+			changed[owner] = true
+		}
+	}
+	if len(changed) == 0 {
+		return nil, false, nil
+	}
+
+	var owners []string
+	for _, project := range projects {
+		if changed[project] {
+			owners = append(owners, project)
+		}
+	}
+	return owners, true, nil
+}
+
+func isSolutionWideFile(pth string) bool {
+	name := strings.ToLower(filepath.Base(pth))
+	for _, solutionWide := range solutionWideFiles {
+		if name == strings.ToLower(solutionWide) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRestoreTargets returns the restore targets of the given solutions: the changed projects of a solution if they can be determined,
+// otherwise the solution itself. Without changed files every solution is restored entirely.
+func resolveRestoreTargets(solutions, changedFiles, exts []string) ([]restoreTarget, error) {
+	var targets []restoreTarget
+	for _, solution := range solutions {
+		if len(changedFiles) == 0 {
+			targets = append(targets, restoreTarget{path: solution})
+			continue
+		}
+
+		projects, ok, err := changedProjects(solution, changedFiles, exts)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			targets = append(targets, restoreTarget{path: solution})
+			continue
+		}
+		solutionDir, err := filepath.Abs(filepath.Dir(solution))
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine absolute path of (%s): %s", solution, err)
+		}
+		for _, project := range projects {
+			targets = append(targets, restoreTarget{path: project, solutionDir: solutionDir})
+		}
+	}
+	return targets, nil
+}
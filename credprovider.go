@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	nuGetPluginPathsEnv         = "NUGET_PLUGIN_PATHS"
+	nuGetCredentialProvidersEnv = "NUGET_CREDENTIALPROVIDERS_PATH"
+)
+
+// isCredentialProvider reports whether the given file is a NuGet credential provider,
+// like CredentialProvider.Microsoft.dll (plugin) or CredentialProvider.VSS.exe (legacy nuget.exe provider).
+func isCredentialProvider(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return strings.HasPrefix(strings.ToLower(name), "credentialprovider") && (ext == ".exe" || ext == ".dll")
+}
+
+// discoverCredentialProviders returns the credential providers found in the given directory.
+func discoverCredentialProviders(dir string) ([]string, error) {
+	if exist, err := pathutil.IsDirExists(dir); err != nil {
+		return nil, fmt.Errorf("failed to check credential provider dir (%s): %s", dir, err)
+	} else if !exist {
+		return nil, fmt.Errorf("credential provider dir (%s) does not exist", dir)
+	}
+
+	var providers []string
+	if err := filepath.Walk(dir, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() && isCredentialProvider(f.Name()) {
+			providers = append(providers, pth)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to discover credential providers in (%s): %s", dir, err)
+	}
+	return providers, nil
+}
+
+// credentialProviderEnvs returns the environment which makes the credential providers available to the restore.
+// The plugins already listed in NUGET_PLUGIN_PATHS are kept, the ones discovered in the given directory are appended.
+// Returns nil if no provider is configured.
+func credentialProviderEnvs(dir string) ([]string, error) {
+	var pluginPaths []string
+	for _, pth := range strings.Split(os.Getenv(nuGetPluginPathsEnv), ";") {
+		if pth = strings.TrimSpace(pth); pth == "" {
+			continue
+		}
+		if exist, err := pathutil.IsPathExists(pth); err != nil || !exist {
+			log.Warnf("Credential provider listed in %s does not exist: %s", nuGetPluginPathsEnv, pth)
+			continue
+		}
+		log.Printf("Credential provider from %s: %s", nuGetPluginPathsEnv, pth)
+		pluginPaths = append(pluginPaths, pth)
+	}
+
+	var envs []string
+	if dir != "" {
+		providers, err := discoverCredentialProviders(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(providers) == 0 {
+			log.Warnf("No credential provider found in %s", dir)
+		}
+		for _, provider := range providers {
+			log.Printf("Discovered credential provider: %s", provider)
+			pluginPaths = append(pluginPaths, provider)
+		}
+		// nuget.exe looks up the legacy CredentialProvider*.exe providers in this directory
+		envs = append(envs, nuGetCredentialProvidersEnv+"="+dir)
+	}
+
+	if len(pluginPaths) == 0 && len(envs) == 0 {
+		return nil, nil
+	}
+	if len(pluginPaths) > 0 {
+		envs = append(envs, nuGetPluginPathsEnv+"="+strings.Join(pluginPaths, ";"))
+	}
+	return envs, nil
+}
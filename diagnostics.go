@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// noProject groups the diagnostics which do not reference a project file.
+const noProject = "(no project)"
+
+var (
+	projectDiagnosticPattern = regexp.MustCompile(`(?mi)^\s*(.+?\.(?:csproj|fsproj|vbproj|sln))(?:\(\d+(?:,\d+)?\))?\s*:\s*(error|warning)\s*(\w*)\s*:\s*(.*?)\s*$`)
+	diagnosticPattern        = regexp.MustCompile(`(?mi)^\s*(error|warning)\s*(NU\d+)?\s*:\s*(.*?)\s*$`)
+)
+
+// restoreDiagnostic is an error or warning printed by the restore.
+type restoreDiagnostic struct {
+	severity string
+	code     string
+	message  string
+}
+
+func (d restoreDiagnostic) String() string {
+	if d.code != "" {
+		return d.severity + " " + d.code + ": " + d.message
+	}
+	return d.severity + ": " + d.message
+}
+
+// parseDiagnosticsByProject groups the errors and warnings of the restore output by the originating project file.
+// Duplicated diagnostics (like the ones repeated in the closing summary of MSBuild) are listed once.
+func parseDiagnosticsByProject(output string) map[string][]restoreDiagnostic {
+	diagnostics := map[string][]restoreDiagnostic{}
+	seen := map[string]bool{}
+	add := func(project string, diagnostic restoreDiagnostic) {
+		key := project + "|" + diagnostic.String()
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		diagnostics[project] = append(diagnostics[project], diagnostic)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if match := projectDiagnosticPattern.FindStringSubmatch(line); match != nil {
+			add(strings.TrimSpace(match[1]), restoreDiagnostic{severity: strings.ToLower(match[2]), code: match[3], message: match[4]})
+		} else if match := diagnosticPattern.FindStringSubmatch(line); match != nil {
+			add(noProject, restoreDiagnostic{severity: strings.ToLower(match[1]), code: match[2], message: match[3]})
+		}
+	}
+	return diagnostics
+}
+
+// logDiagnosticsByProject prints a per project summary of the errors and warnings of the restore output.
+func logDiagnosticsByProject(output string) {
+	diagnostics := parseDiagnosticsByProject(output)
+	if len(diagnostics) == 0 {
+		log.Printf("No errors or warnings found in the restore output")
+		return
+	}
+
+	var projects []string
+	for project := range diagnostics {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+
+	for _, project := range projects {
+		errors, warnings := 0, 0
+		for _, diagnostic := range diagnostics[project] {
+			if diagnostic.severity == "error" {
+				errors++
+			} else {
+				warnings++
+			}
+		}
+
+		log.Printf("%s: %d error(s), %d warning(s)", project, errors, warnings)
+		for _, diagnostic := range diagnostics[project] {
+			if diagnostic.severity == "error" {
+				log.Errorf("  %s", diagnostic)
+			} else {
+				log.Warnf("  %s", diagnostic)
+			}
+		}
+	}
+}
+
+// restoreHint is an actionable explanation of a well known restore failure, recognized by its pattern in the restore output.
+type restoreHint struct {
+	pattern *regexp.Regexp
+	hint    string
+}
+
+var restoreHints = []restoreHint{
+	{
+		pattern: regexp.MustCompile(`(?i)Unable to find (?:version|package)`),
+		hint:    "A package (version) is not available on the configured sources, check the package version and the package sources of the NuGet.config.",
+	},
+	{
+		pattern: regexp.MustCompile(`(?i)401 \(Unauthorized\)|403 \(Forbidden\)`),
+		hint:    "This looks like an authentication problem, check the credentials of the private feeds (feed_credentials_json, package_source_* inputs, netrc or credential providers).",
+	},
+	{
+		pattern: regexp.MustCompile(`(?i)Unable to load the service index`),
+		hint:    "A package source is unreachable or its URL is wrong, check the source URLs and the network (proxy) settings.",
+	},
+	{
+		pattern: regexp.MustCompile(`(?i)The SSL connection could not be established|The remote certificate is invalid`),
+		hint:    "The TLS connection to a package source failed, check the certificates of the source and the proxy.",
+	},
+}
+
+// restoreHintsFor returns the hints of the well known failures found in the restore output, in the order of restoreHints.
+func restoreHintsFor(output string) []string {
+	var hints []string
+	for _, h := range restoreHints {
+		if h.pattern.MatchString(output) {
+			hints = append(hints, h.hint)
+		}
+	}
+	return hints
+}
+
+// logRestoreHints prints the hints of the well known failures found in the restore output.
+func logRestoreHints(output string) {
+	hints := restoreHintsFor(output)
+	if len(hints) == 0 {
+		return
+	}
+
+	fmt.Println()
+	log.Infof("Hints:")
+	for _, hint := range hints {
+		log.Warnf("- %s", hint)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// dirSizeConcurrency is the maximum number of directories read at the same time by dirSize.
+const dirSizeConcurrency = 8
+
+// dirSize returns the total size of the regular files under the given directory.
+// The directories are read by walkDirs, at most concurrency directories at a time.
+// Symlinks are not followed.
+func dirSize(root string, concurrency int) (int64, error) {
+	var total int64
+	err := walkDirs(root, concurrency, func(dir string, entries []os.FileInfo) []string {
+		var size int64
+		var subdirs []string
+		for _, entry := range entries {
+			if entry.IsDir() {
+				subdirs = append(subdirs, filepath.Join(dir, entry.Name()))
+			} else if entry.Mode().IsRegular() {
+				size += entry.Size()
+			}
+		}
+		atomic.AddInt64(&total, size)
+		return subdirs
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// walkDirs reads the directory tree under root with a pool of concurrency workers, so at most concurrency directories are read at a time
+// independently of the size of the tree. visit is called with the entries of each directory, possibly concurrently,
+// and returns the subdirectories to read next.
+// The error of the first failing directory in lexical order is returned, so the result does not depend on the scheduling.
+func walkDirs(root string, concurrency int, visit func(dir string, entries []os.FileInfo) []string) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		cond = sync.NewCond(&mu)
+		// queue holds the directories to read, pending counts them together with the ones being read.
+		queue   = []string{root}
+		pending = 1
+		errs    = map[string]error{}
+	)
+
+	worker := func() {
+		defer wg.Done()
+		for {
+			mu.Lock()
+			for len(queue) == 0 && pending > 0 {
+				cond.Wait()
+			}
+			if pending == 0 {
+				mu.Unlock()
+				return
+			}
+			dir := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			mu.Unlock()
+
+			var subdirs []string
+			entries, err := ioutil.ReadDir(dir)
+			if err == nil {
+				subdirs = visit(dir, entries)
+			}
+
+			mu.Lock()
+			if err != nil {
+				errs[dir] = err
+			}
+			queue = append(queue, subdirs...)
+			pending += len(subdirs) - 1
+			mu.Unlock()
+			cond.Broadcast()
+		}
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go worker()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		var dirs []string
+		for dir := range errs {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		return errs[dirs[0]]
+	}
+	return nil
+}
+
+// cachedSize returns the total size of the cached paths and logs the size of each of them.
+// A path which can not be measured (for example because it does not exist) is logged and skipped.
+func cachedSize(paths cachedPaths) int64 {
+	var total int64
+	for _, pth := range paths.all() {
+		size, err := pathSize(pth)
+		if err != nil {
+			log.Warnf("Failed to determine the size of (%s): %s", pth, err)
+			continue
+		}
+		log.Printf("%s: %s", pth, formatSize(size))
+		total += size
+	}
+	return total
+}
+
+// pathSize returns the size of the given file, or the total size of the files under the given directory.
+func pathSize(pth string) (int64, error) {
+	info, err := os.Stat(pth)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	return dirSize(pth, dirSizeConcurrency)
+}
+
+// formatSize formats the given number of bytes in MB.
+func formatSize(bytes int64) string {
+	return fmt.Sprintf("%.1f MB", megabytes(bytes))
+}
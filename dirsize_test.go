@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createTree creates a directory tree of the given depth under root, with fanout subdirectories
+// and files files of fileSize bytes in each directory. It returns the total size of the files.
+func createTree(tb testing.TB, root string, depth, fanout, files, fileSize int) int64 {
+	var total int64
+	for i := 0; i < files; i++ {
+		if err := ioutil.WriteFile(filepath.Join(root, fmt.Sprintf("file%d", i)), make([]byte, fileSize), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		total += int64(fileSize)
+	}
+	if depth == 0 {
+		return total
+	}
+	for i := 0; i < fanout; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		total += createTree(tb, dir, depth-1, fanout, files, fileSize)
+	}
+	return total
+}
+
+func TestDirSize(t *testing.T) {
+	root := t.TempDir()
+	want := createTree(t, root, 3, 3, 2, 100)
+	if err := os.Symlink(filepath.Join(root, "file0"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{0, 1, 8} {
+		got, err := dirSize(root, concurrency)
+		if err != nil {
+			t.Fatalf("dirSize(%d) error = %s", concurrency, err)
+		}
+		if got != want {
+			t.Errorf("dirSize(%d) = %d, want %d", concurrency, got, want)
+		}
+	}
+
+	if _, err := dirSize(filepath.Join(root, "missing"), dirSizeConcurrency); err == nil {
+		t.Error("dirSize() of a missing directory succeeded, want an error")
+	}
+}
+
+func BenchmarkDirSize(b *testing.B) {
+	root := b.TempDir()
+	createTree(b, root, 4, 6, 4, 1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dirSize(root, dirSizeConcurrency); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	feedSourceNamePrefix     = "BitriseFeed"
+	packageSourceName        = "bitrise"
+	gitHubPackagesSourceName = "github"
+	gitHubPackagesSourceFmt  = "https://nuget.pkg.github.com/%s/index.json"
+	redactedValue            = "[REDACTED]"
+)
+
+// gitHubOwnerPattern matches GitHub user and organization names.
+var gitHubOwnerPattern = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+// feedCredential is the username - password pair of a private feed.
+type feedCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// feedSource is a private feed added to the NuGet config with its credentials.
+type feedSource struct {
+	name       string
+	url        string
+	credential feedCredential
+}
+
+// parseFeedCredentials parses the feed URL to credential map of the feed_credentials_json input.
+// The feeds are named BitriseFeed1, BitriseFeed2, ... in the order of their URLs.
+func parseFeedCredentials(content string) ([]feedSource, error) {
+	var credentials map[string]feedCredential
+	decoder := json.NewDecoder(strings.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&credentials); err != nil {
+		// The decoder error never contains the values of the JSON, so the secrets are not leaked.
+		return nil, fmt.Errorf("invalid feed credentials JSON, expected {\"<feed URL>\": {\"username\": \"...\", \"password\": \"...\"}}: %s", err)
+	}
+
+	var urls []string
+	for feedURL := range credentials {
+		urls = append(urls, feedURL)
+	}
+	sort.Strings(urls)
+
+	var feeds []feedSource
+	for i, feedURL := range urls {
+		if err := validateSourceURL(feedURL); err != nil {
+			return nil, err
+		}
+		credential := credentials[feedURL]
+		if credential.Username == "" || credential.Password == "" {
+			return nil, fmt.Errorf("feed (%s) has no username or password", feedURL)
+		}
+		feeds = append(feeds, feedSource{name: fmt.Sprintf("%s%d", feedSourceNamePrefix, i+1), url: feedURL, credential: credential})
+	}
+	return feeds, nil
+}
+
+// newPackageSource returns the feed of the package_source_url, package_source_username and package_source_password inputs.
+// Either all of them or none of them has to be set, the second return value is false if none of them is set.
+func newPackageSource(sourceURL, username, password string) (feedSource, bool, error) {
+	if sourceURL == "" && username == "" && password == "" {
+		return feedSource{}, false, nil
+	}
+	if sourceURL == "" || username == "" || password == "" {
+		return feedSource{}, false, fmt.Errorf("package_source_url, package_source_username and package_source_password have to be set together")
+	}
+	if err := validateSourceURL(sourceURL); err != nil {
+		return feedSource{}, false, err
+	}
+	return feedSource{name: packageSourceName, url: sourceURL, credential: feedCredential{Username: username, Password: password}}, true, nil
+}
+
+// newGitHubPackagesSource returns the GitHub Packages feed of the github_packages_owner and github_packages_token inputs.
+// Both or none of them has to be set, the second return value is false if none of them is set.
+// GitHub Packages ignores the username, the owner is used.
+func newGitHubPackagesSource(owner, token string) (feedSource, bool, error) {
+	if owner == "" && token == "" {
+		return feedSource{}, false, nil
+	}
+	if owner == "" || token == "" {
+		return feedSource{}, false, fmt.Errorf("github_packages_owner and github_packages_token have to be set together")
+	}
+	if !gitHubOwnerPattern.MatchString(owner) {
+		return feedSource{}, false, fmt.Errorf("github_packages_owner (%s) is not a valid GitHub user or organization name", owner)
+	}
+	return feedSource{
+		name:       gitHubPackagesSourceName,
+		url:        fmt.Sprintf(gitHubPackagesSourceFmt, owner),
+		credential: feedCredential{Username: owner, Password: token},
+	}, true, nil
+}
+
+// addSourceCommands returns the commands removing a previously added source with the same name and adding the feed with its credentials.
+// The dotnet and msbuild restore tools do not use nuget.exe, dotnet is used for them instead.
+func addSourceCommands(restoreTool string, nuGetCmdArgs []string, feed feedSource) ([]string, []string, error) {
+	if !usesNuGetExe(restoreTool) {
+		dotnetPth, err := exec.LookPath("dotnet")
+		if err != nil {
+			return nil, nil, fmt.Errorf("dotnet is not found on PATH: %s", err)
+		}
+		return []string{dotnetPth, "nuget", "remove", "source", feed.name},
+			[]string{dotnetPth, "nuget", "add", "source", feed.url, "--name", feed.name,
+				"--username", feed.credential.Username, "--password", feed.credential.Password, "--store-password-in-clear-text"},
+			nil
+	}
+
+	base := append([]string{}, nuGetCmdArgs...)
+	// Mono can not encrypt the password, it has to be stored in clear text.
+	return append(append([]string{}, base...), "sources", "remove", "-Name", feed.name),
+		append(append([]string{}, base...), "sources", "add", "-Name", feed.name, "-Source", feed.url,
+			"-Username", feed.credential.Username, "-Password", feed.credential.Password, "-StorePasswordInClearText"),
+		nil
+}
+
+// redactArgs returns the printable form of the given command args with the given secrets masked.
+func redactArgs(cmdArgs []string, secrets ...string) string {
+	printable := command.PrintableCommandArgs(false, cmdArgs)
+	for _, secret := range secrets {
+		if secret != "" {
+			printable = strings.Replace(printable, secret, redactedValue, -1)
+		}
+	}
+	return printable
+}
+
+// addFeedSources adds the given feeds with their credentials to the user level NuGet config.
+func addFeedSources(restoreTool string, nuGetCmdArgs []string, feeds []feedSource) error {
+	for _, feed := range feeds {
+		removeArgs, addArgs, err := addSourceCommands(restoreTool, nuGetCmdArgs, feed)
+		if err != nil {
+			return err
+		}
+
+		// The source only exists if a previous run on the same machine added it, a failed removal is expected.
+		if removeCmd, err := command.NewFromSlice(removeArgs); err == nil {
+			_, _ = removeCmd.RunAndReturnTrimmedCombinedOutput()
+		}
+
+		addCmd, err := command.NewFromSlice(addArgs)
+		if err != nil {
+			return fmt.Errorf("failed to create sources add command: %s", err)
+		}
+		printable := redactArgs(addArgs, feed.credential.Username, feed.credential.Password)
+		log.Donef("$ %s", printable)
+		if out, err := addCmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %s, output: %s", printable, err, redactArgs([]string{out}, feed.credential.Username, feed.credential.Password))
+		}
+		log.Printf("Added package source %s: %s", feed.name, feed.url)
+	}
+	return nil
+}
+
+// addPrivateFeeds adds the feeds to the user level NuGet config, and registers their removal before the first one is added,
+// so that the clear text credentials are removed on every exit path, even if adding a later feed fails.
+func addPrivateFeeds(restoreTool string, nuGetCmdArgs []string, feeds []feedSource) error {
+	addCleanup(func() {
+		fmt.Println()
+		log.Infof("Removing private feeds...")
+		removeFeedSources(restoreTool, nuGetCmdArgs, feeds)
+	})
+	return addFeedSources(restoreTool, nuGetCmdArgs, feeds)
+}
+
+// removeFeedSources removes the given feeds from the user level NuGet config, so their credentials do not outlive the step.
+func removeFeedSources(restoreTool string, nuGetCmdArgs []string, feeds []feedSource) {
+	for _, feed := range feeds {
+		removeArgs, _, err := addSourceCommands(restoreTool, nuGetCmdArgs, feed)
+		if err != nil {
+			log.Warnf("Failed to remove package source %s: %s", feed.name, err)
+			continue
+		}
+
+		removeCmd, err := command.NewFromSlice(removeArgs)
+		if err != nil {
+			log.Warnf("Failed to create sources remove command: %s", err)
+			continue
+		}
+		log.Donef("$ %s", removeCmd.PrintableCommandArgs())
+		if out, err := removeCmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
+			log.Warnf("Failed to remove package source %s: %s, output: %s", feed.name, err, out)
+			continue
+		}
+		log.Printf("Removed package source %s", feed.name)
+	}
+}
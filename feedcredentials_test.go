@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSourcesNuGet returns the command args of a fake nuget.exe which logs its sources commands to the returned file,
+// adding the source named failingSource fails.
+func fakeSourcesNuGet(t *testing.T, failingSource string) ([]string, string) {
+	dir := t.TempDir()
+	logPth := filepath.Join(dir, "sources.log")
+	scriptPth := filepath.Join(dir, "nuget.sh")
+	script := fmt.Sprintf(`echo "$1 $2 $4" >> "%s"; if [ "$2" = add ] && [ "$4" = "%s" ]; then exit 1; fi`, logPth, failingSource)
+	if err := ioutil.WriteFile(scriptPth, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return []string{"sh", scriptPth}, logPth
+}
+
+// exitPanic is the exit code the step exits with in catchExit.
+type exitPanic int
+
+// catchExit runs f, which is expected to fail the step, and returns the exit code it exits with.
+func catchExit(t *testing.T, f func()) (code int) {
+	t.Helper()
+	osExit = func(code int) { panic(exitPanic(code)) }
+	defer func() { osExit = os.Exit }()
+	defer func() {
+		r := recover()
+		exit, ok := r.(exitPanic)
+		if !ok {
+			t.Fatalf("expected the step to exit, recovered: %v", r)
+		}
+		code = int(exit)
+	}()
+	f()
+	return 0
+}
+
+func TestAddPrivateFeedsRemovedOnFailure(t *testing.T) {
+	feeds := []feedSource{
+		{name: "BitriseFeed1", url: "https://feed1.example.com/index.json", credential: feedCredential{Username: "user", Password: "secret1"}},
+		{name: "BitriseFeed2", url: "https://feed2.example.com/index.json", credential: feedCredential{Username: "user", Password: "secret2"}},
+	}
+
+	tests := []struct {
+		name          string
+		failingSource string
+		failAfterAdd  bool
+		wantLog       []string
+	}{
+		{
+			name:         "step fails after the feeds are added",
+			failAfterAdd: true,
+			wantLog: []string{
+				"sources remove BitriseFeed1", "sources add BitriseFeed1",
+				"sources remove BitriseFeed2", "sources add BitriseFeed2",
+				"sources remove BitriseFeed1", "sources remove BitriseFeed2",
+			},
+		},
+		{
+			name:          "adding a later feed fails",
+			failingSource: "BitriseFeed2",
+			wantLog: []string{
+				"sources remove BitriseFeed1", "sources add BitriseFeed1",
+				"sources remove BitriseFeed2", "sources add BitriseFeed2",
+				"sources remove BitriseFeed1", "sources remove BitriseFeed2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() { cleanups = nil }()
+			nuGetCmdArgs, logPth := fakeSourcesNuGet(t, tt.failingSource)
+
+			code := catchExit(t, func() {
+				if err := addPrivateFeeds(restoreToolNuGet, nuGetCmdArgs, feeds); err != nil {
+					fail("Failed to add private feeds: %s", err)
+				}
+				if tt.failAfterAdd {
+					fail("restore failed")
+				}
+			})
+			if code != 1 {
+				t.Errorf("exit code = %d, want 1", code)
+			}
+
+			content, err := ioutil.ReadFile(logPth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(strings.TrimSpace(string(content)), "\n"); strings.Join(got, "\n") != strings.Join(tt.wantLog, "\n") {
+				t.Errorf("sources commands = %q, want %q", got, tt.wantLog)
+			}
+			if len(cleanups) != 0 {
+				t.Errorf("%d cleanup(s) left after the step failed", len(cleanups))
+			}
+		})
+	}
+}
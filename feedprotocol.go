@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	feedProtocolAuto = "auto"
+	feedProtocolV2   = "2"
+	feedProtocolV3   = "3"
+)
+
+// detectFeedProtocol returns the protocol version NuGet uses for the given source URL.
+// NuGet does not probe the feed: a source is a v3 feed only if its URL points to the service index (index.json),
+// every other http(s) source is used with the v2 (OData) protocol.
+func detectFeedProtocol(source string) string {
+	u, err := url.Parse(source)
+	if err == nil && strings.HasSuffix(strings.ToLower(strings.TrimSuffix(u.Path, "/")), "/index.json") {
+		return feedProtocolV3
+	}
+	return feedProtocolV2
+}
+
+// checkFeedProtocol validates the expected protocol version of the given source
+// and warns if a v2 source is restored with a tool which is built around v3 feeds.
+func checkFeedProtocol(source, expected, restoreTool string) error {
+	detected := detectFeedProtocol(source)
+	log.Printf("%s is used as a NuGet v%s feed", source, detected)
+
+	switch {
+	case expected == feedProtocolV3 && detected != feedProtocolV3:
+		return fmt.Errorf("source (%s) is expected to be a v3 feed, but NuGet only uses v3 for service index URLs, use the feed's index.json URL", source)
+	case expected == feedProtocolV2 && detected != feedProtocolV2:
+		return fmt.Errorf("source (%s) is expected to be a v2 feed, but it is a v3 service index URL", source)
+	}
+
+	if detected == feedProtocolV2 && restoreTool != restoreToolNuGet {
+		log.Warnf("%s is a v2 feed, dotnet and msbuild restores are slower and less reliable with v2 feeds", source)
+		log.Warnf("If the feed supports v3, use its index.json URL")
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	nuGetLocalsGlobalPackages = "global-packages"
+	nuGetLocalsAll            = "all"
+)
+
+// clearNuGetLocals clears the given NuGet local cache (like global-packages or all) with nuget locals,
+// or with dotnet nuget locals for the restore tools which do not use nuget.exe.
+func clearNuGetLocals(restoreTool string, nuGetCmdArgs []string, cacheName string) error {
+	cmdArgs := append(append([]string{}, nuGetCmdArgs...), "locals", cacheName, "-clear")
+	if !usesNuGetExe(restoreTool) {
+		dotnetPth, err := exec.LookPath("dotnet")
+		if err != nil {
+			return fmt.Errorf("dotnet is not found on PATH: %s", err)
+		}
+		cmdArgs = []string{dotnetPth, "nuget", "locals", cacheName, "--clear"}
+	}
+
+	cmd, err := command.NewFromSlice(cmdArgs)
+	if err != nil {
+		return fmt.Errorf("failed to create locals command: %s", err)
+	}
+	log.Donef("$ %s", cmd.PrintableCommandArgs())
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s, output: %s", cmd.PrintableCommandArgs(), err, out)
+	}
+	log.Printf("%s", out)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const nuGetLockFile = "packages.lock.json"
+
+// collectLockFiles returns the set of packages.lock.json files found under the given base path.
+func collectLockFiles(basePth string) (map[string]bool, error) {
+	lockFiles := map[string]bool{}
+	if err := filepath.Walk(basePth, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() && f.Name() == nuGetLockFile {
+			lockFiles[pth] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to collect %s files: %s", nuGetLockFile, err)
+	}
+	return lockFiles, nil
+}
+
+// logLockedModeHints explains the locked mode failures of the restore output.
+func logLockedModeHints(output string, packagesConfigProjects bool) {
+	if strings.Contains(output, "NU1004") {
+		log.Errorf("The %s files are out of date (NU1004), restore without locked_mode and commit the updated lock files", nuGetLockFile)
+	}
+	if packagesConfigProjects {
+		log.Errorf("The solution has %s projects, locked mode only supports PackageReference projects", packagesConfigFile)
+	}
+}
+
+// hasPackagesConfig reports whether a packages.config file exists under the given base path.
+func hasPackagesConfig(basePth string) (bool, error) {
+	found := false
+	err := filepath.Walk(basePth, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() && f.Name() == packagesConfigFile {
+			found = true
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to search %s files: %s", packagesConfigFile, err)
+	}
+	return found, nil
+}
+
+// newLockFiles returns the lock files which exist after the restore, but did not exist before it, sorted.
+func newLockFiles(before, after map[string]bool) []string {
+	var created []string
+	for pth := range after {
+		if !before[pth] {
+			created = append(created, pth)
+		}
+	}
+	sort.Strings(created)
+	return created
+}
@@ -3,31 +3,200 @@ package main
 import (
 	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
+	"net/url"
 	"os"
-	"path"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bitrise-io/go-steputils/stepconf"
-	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-steputils/tools"
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/bitrise-io/go-utils/pathutil"
-	"github.com/bitrise-io/go-utils/retry"
 	"github.com/bitrise-io/go-xamarin/constants"
 	"github.com/bitrise-tools/go-steputils/cache"
 )
 
 // ConfigsModel ...
 type ConfigsModel struct {
-	XamarinSolution string `env:"xamarin_solution,file"`
-	NuGetVersion    string `env:"nuget_version"`
-	CacheLevel      string `env:"cache_level,opt[local,global,all,none]"`
+	XamarinSolution       string          `env:"xamarin_solution"`
+	NuGetVersion          string          `env:"nuget_version"`
+	CacheLevel            string          `env:"cache_level"`
+	ClearObj              bool            `env:"clear_obj,opt[yes,no]"`
+	RestoreTimeout        int             `env:"restore_timeout"`
+	FirstRunTimeout       int             `env:"first_run_timeout"`
+	UseNetrc              bool            `env:"use_netrc,opt[yes,no]"`
+	FailureReasonPath     string          `env:"failure_reason_path"`
+	MirrorSource          string          `env:"mirror_source"`
+	FallbackToPublic      bool            `env:"fallback_to_public,opt[yes,no]"`
+	PerPackageTiming      bool            `env:"per_package_timing,opt[yes,no]"`
+	PackagesArchive       string          `env:"packages_archive"`
+	PackagesArchiveTarget string          `env:"packages_archive_target"`
+	CheckTargetFrameworks bool            `env:"check_target_frameworks,opt[yes,no]"`
+	CleanRestoreArtifacts bool            `env:"clean_restore_artifacts,opt[yes,no]"`
+	RestoreTool           string          `env:"restore_tool,opt[nuget,dotnet,both,msbuild,auto]"`
+	MSBuildRestoreProps   string          `env:"msbuild_restore_properties"`
+	GroupErrorsByProject  bool            `env:"group_errors_by_project,opt[yes,no]"`
+	RetryErrorCodes       string          `env:"retry_error_codes"`
+	PrintDependencyTree   bool            `env:"print_dependency_tree,opt[yes,no]"`
+	SupportPaket          bool            `env:"support_paket,opt[yes,no]"`
+	FailOnNewLockFile     bool            `env:"fail_on_new_lockfile,opt[yes,no]"`
+	SBOMOutputPath        string          `env:"sbom_output_path"`
+	AllowNoSolutions      bool            `env:"allow_no_solutions,opt[yes,no]"`
+	CredentialProviderDir string          `env:"credential_provider_dir"`
+	RetryJitterPercent    int             `env:"retry_jitter_percent,range[0..100]"`
+	RestoreOutputDir      string          `env:"restore_output_dir"`
+	LogSources            bool            `env:"log_sources,opt[yes,no]"`
+	DeterministicRestore  bool            `env:"deterministic_restore,opt[yes,no]"`
+	PreflightCheck        bool            `env:"preflight_connectivity_check,opt[yes,no]"`
+	VendoredNuGetPath     string          `env:"vendored_nuget_path"`
+	AtomicRestore         bool            `env:"atomic_restore,opt[yes,no]"`
+	MirrorProtocol        string          `env:"mirror_protocol_version,opt[auto,2,3]"`
+	ExportToTestAddon     bool            `env:"export_to_test_addon,opt[yes,no]"`
+	CleanGlobalCache      bool            `env:"clean_global_cache,opt[yes,no]"`
+	RestorableExtensions  string          `env:"restorable_extensions"`
+	FailFast              bool            `env:"fail_fast,opt[yes,no]"`
+	Verbosity             string          `env:"verbosity,opt[quiet,normal,detailed]"`
+	ClearLocalCaches      bool            `env:"clear_local_caches,opt[yes,no]"`
+	LockedMode            bool            `env:"locked_mode,opt[yes,no]"`
+	UseLockFile           bool            `env:"use_lock_file,opt[yes,no]"`
+	SummaryOutputPath     string          `env:"summary_output_path"`
+	FailOnCacheError      bool            `env:"fail_on_cache_error,opt[yes,no]"`
+	PackageSourceURL      string          `env:"package_source_url"`
+	PackageSourceUsername string          `env:"package_source_username"`
+	PackageSourcePassword stepconf.Secret `env:"package_source_password"`
+	NuGetPath             string          `env:"nuget_path"`
+	CacheExcludePaths     string          `env:"cache_exclude_paths"`
+	SolutionDirectory     string          `env:"solution_directory"`
+	FallbackToSystemNuGet bool            `env:"fallback_to_system_nuget,opt[yes,no]"`
+	DryRun                bool            `env:"dry_run,opt[yes,no]"`
+	GlobalPackagesFolder  string          `env:"global_packages_folder"`
+	NoCache               bool            `env:"no_cache,opt[yes,no]"`
+	ReportCacheSize       bool            `env:"report_cache_size,opt[yes,no]"`
+	ForceEnglishOutput    bool            `env:"force_english_output,opt[yes,no]"`
+	ChangedFiles          string          `env:"changed_files"`
+	DownloadDir           string          `env:"download_dir"`
+	StrictRestoreStyle    bool            `env:"strict_restore_style,opt[yes,no]"`
+	CacheRestoreArtifacts bool            `env:"cache_restore_artifacts,opt[yes,no]"`
+	DownloadRetryCount    int             `env:"download_retry_count,range[0..10]"`
+	NuGetSources          string          `env:"nuget_sources"`
+	PrivateFeeds          stepconf.Secret `env:"private_feeds"`
+	AzureCredProvider     bool            `env:"install_azure_credential_provider,opt[yes,no]"`
+	AzureFeedEndpoints    stepconf.Secret `env:"azure_feed_endpoints"`
+	GitHubPackagesOwner   string          `env:"github_packages_owner"`
+	GitHubPackagesToken   stepconf.Secret `env:"github_packages_token"`
+	ValidateSourceMapping bool            `env:"validate_source_mapping,opt[yes,no]"`
+	NoHTTPCache           bool            `env:"no_http_cache,opt[yes,no]"`
+	MSBuildPath           string          `env:"msbuild_path"`
+	MSBuildVersion        string          `env:"msbuild_version"`
+	FeedCredentialsJSON   stepconf.Secret `env:"feed_credentials_json"`
+	VerifyAuthenticode    bool            `env:"verify_authenticode,opt[yes,no]"`
+	AuthenticodeSigner    string          `env:"authenticode_signer"`
+	SignerThumbprint      string          `env:"signer_thumbprint"`
+	RestoreRetryCount     int             `env:"restore_retry_count,range[0..10]"`
+	RestoreRetryWait      int             `env:"restore_retry_wait,range[0..600]"`
+	RestoreRetryMaxWait   int             `env:"restore_retry_max_wait,range[1..3600]"`
+	NuGetChecksum         string          `env:"nuget_checksum"`
+	AdditionalArgs        string          `env:"additional_args"`
+	NuGetConfigFile       string          `env:"nuget_config_file"`
+	PackagesDirectory     string          `env:"packages_directory"`
+	DownloadTimeout       int             `env:"download_timeout,range[1..3600]"`
+	HTTPProxy             string          `env:"http_proxy"`
+	NuGetDownloadBaseURL  string          `env:"nuget_download_base_url"`
+}
+
+// failureReasonPath is the file where the reason of a step failure is written, if set.
+var failureReasonPath string
+
+// cleanups are run before the step exits, on success and on failure alike,
+// so that the credentials stored on the machine for the restore do not outlive the step.
+var cleanups []func()
+
+// osExit exits the step, it is replaced in tests.
+var osExit = os.Exit
+
+// addCleanup registers a function to run before the step exits.
+func addCleanup(cleanup func()) {
+	cleanups = append(cleanups, cleanup)
+}
+
+// runCleanups runs the registered cleanups in reverse order of registration, each of them once.
+func runCleanups() {
+	for len(cleanups) > 0 {
+		cleanup := cleanups[len(cleanups)-1]
+		cleanups = cleanups[:len(cleanups)-1]
+		cleanup()
+	}
 }
 
 func fail(format string, v ...interface{}) {
+	failWithCategory(failureCategoryUnknown, format, v...)
+}
+
+// failWithCategory writes the failure reason to the failure reason file and exits the step with exit code 1.
+func failWithCategory(category, format string, v ...interface{}) {
+	failWithExitCode(category, 1, format, v...)
+}
+
+// failWithExitCode writes the failure reason to the failure reason file and exits the step with the given exit code.
+func failWithExitCode(category string, code int, format string, v ...interface{}) {
+	runCleanups()
+
+	if failureReasonPath != "" {
+		if err := writeFailureReason(failureReasonPath, category, fmt.Sprintf(format, v...)); err != nil {
+			log.Warnf("Failed to write failure reason: %s", err)
+		}
+	}
+
+	exportRestoreStatus(restoreStatusFailure)
+	writeStepSummary(restoreStatusFailure)
+
 	log.Errorf(format, v...)
-	os.Exit(1)
+	osExit(code)
+}
+
+// exitCode returns the exit code of the process which returned the given error,
+// or 1 if the process did not exit on its own (e.g. it could not be started or it was killed).
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if code := exitErr.ExitCode(); code > 0 {
+			return code
+		}
+	}
+	return 1
+}
+
+// exportSolutionCounts exports the number of the succeeded and failed solution restores.
+func exportSolutionCounts(succeeded, failed int) {
+	for key, value := range map[string]string{
+		succeededCountEnvKey: strconv.Itoa(succeeded),
+		failedCountEnvKey:    strconv.Itoa(failed),
+	} {
+		if err := tools.ExportEnvironmentWithEnvman(key, value); err != nil {
+			log.Warnf("Failed to export %s: %s", key, err)
+		}
+	}
+}
+
+// exportRestoreStatus exports the overall outcome of the step, so that later always run steps can branch on it.
+func exportRestoreStatus(status string) {
+	if err := tools.ExportEnvironmentWithEnvman(restoreStatusEnvKey, status); err != nil {
+		log.Warnf("Failed to export %s: %s", restoreStatusEnvKey, err)
+	}
+}
+
+// writeFailureReason writes a single line failure reason formatted as '<category>: <message>' to the given file.
+// An empty reason clears the file.
+func writeFailureReason(pth, category, message string) error {
+	content := ""
+	if category != "" || message != "" {
+		content = fmt.Sprintf("%s: %s\n", category, strings.Join(strings.Fields(message), " "))
+	}
+	return ioutil.WriteFile(pth, []byte(content), 0644)
 }
 
 func (configs ConfigsModel) print() {
@@ -35,6 +204,88 @@ func (configs ConfigsModel) print() {
 
 	log.Printf("- XamarinSolution: %s", configs.XamarinSolution)
 	log.Printf("- NuGetVersion: %s", configs.NuGetVersion)
+	log.Printf("- CacheLevel: %s", configs.CacheLevel)
+	log.Printf("- ClearObj: %t", configs.ClearObj)
+	log.Printf("- RestoreTimeout: %d", configs.RestoreTimeout)
+	log.Printf("- FirstRunTimeout: %d", configs.FirstRunTimeout)
+	log.Printf("- UseNetrc: %t", configs.UseNetrc)
+	log.Printf("- FailureReasonPath: %s", configs.FailureReasonPath)
+	log.Printf("- MirrorSource: %s", configs.MirrorSource)
+	log.Printf("- FallbackToPublic: %t", configs.FallbackToPublic)
+	log.Printf("- PerPackageTiming: %t", configs.PerPackageTiming)
+	log.Printf("- PackagesArchive: %s", configs.PackagesArchive)
+	log.Printf("- PackagesArchiveTarget: %s", configs.PackagesArchiveTarget)
+	log.Printf("- CheckTargetFrameworks: %t", configs.CheckTargetFrameworks)
+	log.Printf("- CleanRestoreArtifacts: %t", configs.CleanRestoreArtifacts)
+	log.Printf("- RestoreTool: %s", configs.RestoreTool)
+	log.Printf("- MSBuildRestoreProps: %s", configs.MSBuildRestoreProps)
+	log.Printf("- GroupErrorsByProject: %t", configs.GroupErrorsByProject)
+	log.Printf("- RetryErrorCodes: %s", configs.RetryErrorCodes)
+	log.Printf("- PrintDependencyTree: %t", configs.PrintDependencyTree)
+	log.Printf("- SupportPaket: %t", configs.SupportPaket)
+	log.Printf("- FailOnNewLockFile: %t", configs.FailOnNewLockFile)
+	log.Printf("- SBOMOutputPath: %s", configs.SBOMOutputPath)
+	log.Printf("- AllowNoSolutions: %t", configs.AllowNoSolutions)
+	log.Printf("- CredentialProviderDir: %s", configs.CredentialProviderDir)
+	log.Printf("- RetryJitterPercent: %d", configs.RetryJitterPercent)
+	log.Printf("- RestoreOutputDir: %s", configs.RestoreOutputDir)
+	log.Printf("- LogSources: %t", configs.LogSources)
+	log.Printf("- DeterministicRestore: %t", configs.DeterministicRestore)
+	log.Printf("- PreflightCheck: %t", configs.PreflightCheck)
+	log.Printf("- VendoredNuGetPath: %s", configs.VendoredNuGetPath)
+	log.Printf("- AtomicRestore: %t", configs.AtomicRestore)
+	log.Printf("- MirrorProtocol: %s", configs.MirrorProtocol)
+	log.Printf("- ExportToTestAddon: %t", configs.ExportToTestAddon)
+	log.Printf("- CleanGlobalCache: %t", configs.CleanGlobalCache)
+	log.Printf("- RestorableExtensions: %s", configs.RestorableExtensions)
+	log.Printf("- FailFast: %t", configs.FailFast)
+	log.Printf("- Verbosity: %s", configs.Verbosity)
+	log.Printf("- ClearLocalCaches: %t", configs.ClearLocalCaches)
+	log.Printf("- LockedMode: %t", configs.LockedMode)
+	log.Printf("- UseLockFile: %t", configs.UseLockFile)
+	log.Printf("- SummaryOutputPath: %s", configs.SummaryOutputPath)
+	log.Printf("- FailOnCacheError: %t", configs.FailOnCacheError)
+	log.Printf("- PackageSourceURL: %s", configs.PackageSourceURL)
+	log.Printf("- PackageSourceUsername: %s", configs.PackageSourceUsername)
+	log.Printf("- PackageSourcePassword: %s", configs.PackageSourcePassword)
+	log.Printf("- NuGetPath: %s", configs.NuGetPath)
+	log.Printf("- CacheExcludePaths: %s", configs.CacheExcludePaths)
+	log.Printf("- SolutionDirectory: %s", configs.SolutionDirectory)
+	log.Printf("- FallbackToSystemNuGet: %t", configs.FallbackToSystemNuGet)
+	log.Printf("- DryRun: %t", configs.DryRun)
+	log.Printf("- GlobalPackagesFolder: %s", configs.GlobalPackagesFolder)
+	log.Printf("- NoCache: %t", configs.NoCache)
+	log.Printf("- ReportCacheSize: %t", configs.ReportCacheSize)
+	log.Printf("- ForceEnglishOutput: %t", configs.ForceEnglishOutput)
+	log.Printf("- ChangedFiles: %s", configs.ChangedFiles)
+	log.Printf("- DownloadDir: %s", configs.DownloadDir)
+	log.Printf("- StrictRestoreStyle: %t", configs.StrictRestoreStyle)
+	log.Printf("- CacheRestoreArtifacts: %t", configs.CacheRestoreArtifacts)
+	log.Printf("- DownloadRetryCount: %d", configs.DownloadRetryCount)
+	log.Printf("- NuGetSources: %s", strings.Join(strings.Fields(configs.NuGetSources), ", "))
+	log.Printf("- PrivateFeeds: %s", configs.PrivateFeeds)
+	log.Printf("- AzureCredProvider: %t", configs.AzureCredProvider)
+	log.Printf("- AzureFeedEndpoints: %s", configs.AzureFeedEndpoints)
+	log.Printf("- GitHubPackagesOwner: %s", configs.GitHubPackagesOwner)
+	log.Printf("- GitHubPackagesToken: %s", configs.GitHubPackagesToken)
+	log.Printf("- ValidateSourceMapping: %t", configs.ValidateSourceMapping)
+	log.Printf("- NoHTTPCache: %t", configs.NoHTTPCache)
+	log.Printf("- MSBuildPath: %s", configs.MSBuildPath)
+	log.Printf("- MSBuildVersion: %s", configs.MSBuildVersion)
+	log.Printf("- FeedCredentialsJSON: %s", configs.FeedCredentialsJSON)
+	log.Printf("- VerifyAuthenticode: %t", configs.VerifyAuthenticode)
+	log.Printf("- AuthenticodeSigner: %s", configs.AuthenticodeSigner)
+	log.Printf("- SignerThumbprint: %s", configs.SignerThumbprint)
+	log.Printf("- RestoreRetryCount: %d", configs.RestoreRetryCount)
+	log.Printf("- RestoreRetryWait: %d", configs.RestoreRetryWait)
+	log.Printf("- RestoreRetryMaxWait: %d", configs.RestoreRetryMaxWait)
+	log.Printf("- NuGetChecksum: %s", configs.NuGetChecksum)
+	log.Printf("- AdditionalArgs: %s", configs.AdditionalArgs)
+	log.Printf("- NuGetConfigFile: %s", configs.NuGetConfigFile)
+	log.Printf("- PackagesDirectory: %s", configs.PackagesDirectory)
+	log.Printf("- DownloadTimeout: %d", configs.DownloadTimeout)
+	log.Printf("- HTTPProxy: %s", redactSourceCredentials(configs.HTTPProxy))
+	log.Printf("- NuGetDownloadBaseURL: %s", configs.NuGetDownloadBaseURL)
 }
 
 const (
@@ -42,136 +293,312 @@ const (
 	cacheInputlocal  = "local"
 	cacheInputGlobal = "global"
 	cacheInputAll    = "all"
+	// cacheInputInherit reads the cache level from the cacheLevelEnv env var, as an empty input does.
+	cacheInputInherit = "inherit"
 
 	cacheEnvGlobal = "NUGET_PACKAGES"
+	cacheLevelEnv  = "BITRISE_NUGET_CACHE_LEVEL"
+
+	publicNuGetSource = "https://api.nuget.org/v3/index.json"
+
+	restoreToolNuGet   = "nuget"
+	restoreToolDotnet  = "dotnet"
+	restoreToolBoth    = "both"
+	restoreToolMSBuild = "msbuild"
+	restoreToolAuto    = "auto"
+
+	failureCategoryInput    = "input"
+	failureCategoryDownload = "download"
+	failureCategoryRestore  = "restore"
+	failureCategoryUnknown  = "unknown"
+
+	resolvedVersionEnvKey = "NUGET_RESOLVED_VERSION"
+	restoredCountEnvKey   = "NUGET_RESTORED_COUNT"
+	restoreSecondsEnvKey  = "NUGET_RESTORE_SECONDS"
+	restoreStatusEnvKey   = "NUGET_RESTORE_STATUS"
+	versionUsedEnvKey     = "NUGET_VERSION_USED"
+	succeededCountEnvKey  = "NUGET_RESTORE_SUCCEEDED_COUNT"
+	failedCountEnvKey     = "NUGET_RESTORE_FAILED_COUNT"
+	cachedPathsEnvKey     = "NUGET_CACHED_PATHS"
+
+	restoreStatusSuccess = "success"
+	restoreStatusFailure = "failure"
 )
 
-// DownloadFile ...
-func DownloadFile(downloadURL, targetPath string) error {
-	outFile, err := os.Create(targetPath)
+// restoreArtifactPatterns match the transient restore artifacts left in the obj folders by nuget and dotnet.
+var restoreArtifactPatterns = []string{"*.nuget.dgspec.json", "*.nuget.cache", "*.lock"}
+
+// restoreOutputPatterns match the files the restore of an SDK-style project writes into its obj folder, the build reads them.
+var restoreOutputPatterns = []string{"project.assets.json", "project.nuget.cache", "*.nuget.dgspec.json", "*.nuget.g.props", "*.nuget.g.targets"}
+
+var restoreSummaryPattern = regexp.MustCompile(`Restored (\d+) packages? in (\d+(?:\.\d+)?) ?s`)
+
+// validateSourceURL checks whether the given package source is an absolute http(s) URL.
+func validateSourceURL(source string) error {
+	u, err := url.Parse(source)
 	if err != nil {
-		return fmt.Errorf("failed to create (%s): %s", targetPath, err)
+		return fmt.Errorf("invalid source URL (%s): %s", source, err)
 	}
-	defer func() {
-		if err := outFile.Close(); err != nil {
-			log.Warnf("Failed to close (%s)", targetPath)
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("source URL (%s) must be an absolute http or https URL", source)
+	}
+	return nil
+}
+
+// parseSourceList parses the newline separated package source URLs, empty lines are skipped.
+func parseSourceList(list string) ([]string, error) {
+	var sources []string
+	for _, line := range strings.Split(list, "\n") {
+		source := strings.TrimSpace(line)
+		if source == "" {
+			continue
 		}
-	}()
+		if err := validateSourceURL(source); err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
 
-	resp, err := http.Get(downloadURL)
-	if err != nil {
-		return fmt.Errorf("failed to download from (%s): %s", downloadURL, err)
+// RestoreSummary ...
+type RestoreSummary struct {
+	RestoredCount int
+	Seconds       float64
+}
+
+// parseRestoreSummary parses the "Restored X packages in Ys" summary lines from the restore output.
+// The output of several restores (solutions or restore tools) has several summary lines, their numbers are summed.
+// The second return value is false if the output contains no summary line.
+func parseRestoreSummary(output string) (RestoreSummary, bool) {
+	var summary RestoreSummary
+	found := false
+	for _, match := range restoreSummaryPattern.FindAllStringSubmatch(output, -1) {
+		count, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			continue
+		}
+		summary.RestoredCount += count
+		summary.Seconds += seconds
+		found = true
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Warnf("failed to close (%s) body", downloadURL)
+	return summary, found
+}
+
+// exportRestoreSummary exports the numbers of the restore summary line, if the output contains one.
+func exportRestoreSummary(output string) {
+	summary, ok := parseRestoreSummary(output)
+	if !ok {
+		log.Printf("No restore summary found in the output")
+		return
+	}
+
+	log.Printf("Restored %d packages in %gs", summary.RestoredCount, summary.Seconds)
+	for key, value := range map[string]string{
+		restoredCountEnvKey:  strconv.Itoa(summary.RestoredCount),
+		restoreSecondsEnvKey: strconv.FormatFloat(summary.Seconds, 'f', -1, 64),
+	} {
+		if err := tools.ExportEnvironmentWithEnvman(key, value); err != nil {
+			log.Warnf("Failed to export %s: %s", key, err)
 		}
-	}()
+	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed, status code: %d", resp.StatusCode)
+// restoreTimeout returns the timeout of a restore attempt.
+// The first run timeout is used when no package is cached yet, as a cold restore is far slower than a warm one.
+func restoreTimeout(configs ConfigsModel, basePth string) time.Duration {
+	if configs.FirstRunTimeout > 0 {
+		cold, err := isColdCache(basePth, configs.PackagesDirectory)
+		if err != nil {
+			log.Warnf("Failed to determine whether the package cache is cold: %s", err)
+		} else if cold {
+			log.Printf("No cached packages found, using the first run timeout")
+			return time.Duration(configs.FirstRunTimeout) * time.Second
+		}
 	}
+	return time.Duration(configs.RestoreTimeout) * time.Second
+}
 
-	_, err = io.Copy(outFile, resp.Body)
+// isColdCache reports whether neither the local nor the global packages folders contain any package.
+func isColdCache(basePth, packagesDir string) (bool, error) {
+	localCaches, err := collectLocalCaches(basePth, packagesDir, nil)
 	if err != nil {
-		return fmt.Errorf("failed to copy to (%v): %s", outFile, err)
+		return false, err
 	}
 
-	return nil
+	for _, pth := range append(localCaches, collectGlobalCaches()) {
+		empty, err := isDirEmpty(pth)
+		if err != nil {
+			return false, err
+		}
+		if !empty {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
-// downloadNuGet downloads NuGet with the given version.
-func downloadNuGet(version string) (string, error) {
-	fmt.Println()
-	log.Infof("Downloading NuGet %s version...", version)
-	tmpDir, err := pathutil.NormalizedOSTempDirPath("__nuget__")
-	if err != nil {
-		return "", fmt.Errorf("failed to create tmp dir: %s", err)
+// isDirEmpty reports whether the given directory is empty or absent.
+func isDirEmpty(pth string) (bool, error) {
+	dir, err := os.Open(pth)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
 	}
+	defer func() {
+		if err := dir.Close(); err != nil {
+			log.Warnf("Failed to close (%s)", pth)
+		}
+	}()
 
-	downloadPth := filepath.Join(tmpDir, "nuget.exe")
+	if _, err := dir.Readdirnames(1); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
 
-	// https://dist.nuget.org/win-x86-commandline/latest/nuget.exe or
-	// https://dist.nuget.org/win-x86-commandline/v3.3.0/nuget.exe
+// resolveCacheLevel returns the effective cache level.
+// The precedence is: the cache_level input, the BITRISE_NUGET_CACHE_LEVEL env var, then local.
+func resolveCacheLevel(input string) (string, error) {
+	level, source := input, "cache_level input"
+	if level == "" || level == cacheInputInherit {
+		level, source = os.Getenv(cacheLevelEnv), cacheLevelEnv
+	}
+	if level == "" {
+		return cacheInputlocal, nil
+	}
 
-	if version != "latest" {
-		version = `v` + version
+	switch level {
+	case cacheInputNone, cacheInputlocal, cacheInputGlobal, cacheInputAll:
+		return level, nil
 	}
-	nuGetURL := fmt.Sprintf("https://dist.nuget.org/win-x86-commandline/%s/nuget.exe", version)
+	return "", fmt.Errorf("invalid cache level (%s) set by %s, available values: %s, %s, %s, %s", level, source, cacheInputlocal, cacheInputGlobal, cacheInputAll, cacheInputNone)
+}
 
-	log.Printf("Download URL: %s", nuGetURL)
-	return downloadPth, retry.Times(1).Wait(time.Second).Try(func(attempt uint) error {
-		if attempt > 0 {
-			log.Warnf("Retrying...")
-		}
-		if err := DownloadFile(nuGetURL, downloadPth); err != nil {
-			if attempt < 1 {
-				log.Warnf("Failed to download NuGet: %s", err)
-			}
-			return err
-		}
-		return nil
-	})
+// cachedPaths are the paths included in the cache, by cache level.
+type cachedPaths struct {
+	local  []string
+	global []string
 }
 
-// runRestoreCommand runs the restore command with the given args.
-func runRestoreCommand(cmdArgs []string) error {
-	return retry.Times(1).Try(func(attempt uint) error {
-		if attempt > 0 {
-			log.Warnf("Attempt %d failed, retrying...", attempt)
-		}
+func (p cachedPaths) count() int {
+	return len(p.local) + len(p.global)
+}
+
+// all returns the local paths followed by the global ones.
+func (p cachedPaths) all() []string {
+	return append(append([]string{}, p.local...), p.global...)
+}
 
-		log.Donef("$ %s", command.PrintableCommandArgs(false, cmdArgs))
+// cacheCandidates are the paths which may be cached, selectCachedPaths picks the ones of the cache level.
+type cacheCandidates struct {
+	// packagesDirs are the packages folders of the solutions, see collectSolutionsLocalCaches.
+	packagesDirs []string
+	// globalPackagesDir is the global packages folder, see collectGlobalCaches.
+	globalPackagesDir string
+	// restoreOutputDir is the restore_output_dir, empty if not set.
+	restoreOutputDir string
+	// nuGetBinariesDir keeps the downloaded nuget.exe binaries, empty if they are not cached.
+	nuGetBinariesDir string
+	// restoreArtifacts are the restore artifacts of the obj folders, empty if they are not cached.
+	restoreArtifacts []string
+}
 
-		cmd, err := command.NewFromSlice(cmdArgs)
+// collectCacheCandidates collects the packages folders and the global packages folder.
+// The packages folders are only searched for if the cache level caches them.
+// The local level caches the packages_directory if it is set (see collectLocalCaches), the global level is not affected by it.
+// For more information about caches please read: https://docs.microsoft.com/en-us/nuget/consume-packages/managing-the-global-packages-and-cache-folders
+func collectCacheCandidates(cacheLevel string, basePths []string, packagesDir string, excludes []string) (cacheCandidates, error) {
+	candidates := cacheCandidates{globalPackagesDir: collectGlobalCaches()}
+	if cacheLevel == cacheInputlocal || cacheLevel == cacheInputAll {
+		packagesDirs, err := collectSolutionsLocalCaches(basePths, packagesDir, excludes)
 		if err != nil {
-			fail("Failed to create NuGet command: %s", err)
+			return cacheCandidates{}, fmt.Errorf("error occurred while getting %s cache: %s", cacheLevel, err)
 		}
+		candidates.packagesDirs = packagesDirs
+	}
+	return candidates, nil
+}
 
-		cmd.SetStdout(os.Stdout)
-		cmd.SetStderr(os.Stderr)
-
-		if err := cmd.Run(); err != nil {
-			if attempt < 1 {
-				log.Warnf("Restore failed: %s", err)
-			}
-			return err
-		}
-		return nil
-	})
+// selectCachedPaths returns the cached paths of the given cache level:
+//
+// - none caches nothing.
+// - local caches the packages folders and the restore artifacts.
+// - global caches the global packages folder.
+// - all caches both of them.
+//
+// The restore output dir and the nuget.exe binaries are cached on every level but none.
+func selectCachedPaths(cacheLevel string, candidates cacheCandidates) cachedPaths {
+	var paths cachedPaths
+	if cacheLevel == cacheInputNone {
+		return paths
+	}
+	if cacheLevel == cacheInputlocal || cacheLevel == cacheInputAll {
+		paths.local = append(paths.local, candidates.packagesDirs...)
+	}
+	if cacheLevel == cacheInputGlobal || cacheLevel == cacheInputAll {
+		paths.global = append(paths.global, candidates.globalPackagesDir)
+	}
+	if candidates.restoreOutputDir != "" {
+		paths.local = append(paths.local, candidates.restoreOutputDir)
+	}
+	if candidates.nuGetBinariesDir != "" {
+		paths.global = append(paths.global, candidates.nuGetBinariesDir)
+	}
+	if cacheLevel == cacheInputlocal || cacheLevel == cacheInputAll {
+		paths.local = append(paths.local, candidates.restoreArtifacts...)
+	}
+	return paths
 }
 
-// collectCaches collects the caches based on the config.
-// For more information about caches please read: https://docs.microsoft.com/en-us/nuget/consume-packages/managing-the-global-packages-and-cache-folders
-func collectCaches(cacheLevel string, basePth string) (cache.Cache, error) {
+// newNuGetCache returns the cache of the given paths, keyed to the given indicator file if it is set (see withIndicator).
+// The unkeyed paths do not depend on the restored packages, they are not keyed.
+func newNuGetCache(paths []string, indicator string, unkeyed ...string) cache.Cache {
 	nuGetCache := cache.New()
-	switch cacheLevel {
-	case cacheInputNone:
-		return cache.Cache{}, nil
-	case cacheInputlocal:
-		localCaches, err := collectLocalCaches(basePth)
-		if err != nil {
-			return nuGetCache, fmt.Errorf("error occurred while getting local cache: %s", err)
+	for _, pth := range paths {
+		keyed := true
+		for _, unkeyedPth := range unkeyed {
+			if pth == unkeyedPth {
+				keyed = false
+			}
 		}
-		for _, lcItem := range localCaches {
-			nuGetCache.IncludePath(lcItem)
+		if keyed {
+			nuGetCache.IncludePath(withIndicator(pth, indicator))
+		} else {
+			nuGetCache.IncludePath(pth)
 		}
-	case cacheInputGlobal:
-		nuGetCache.IncludePath(collectGlobalCaches())
-	case cacheInputAll:
-		localCaches, err := collectLocalCaches(basePth)
+	}
+	return nuGetCache
+}
+
+// collectSolutionsLocalCaches collects the local caches of every given solution directory, each path is returned once.
+func collectSolutionsLocalCaches(basePths []string, packagesDir string, excludes []string) ([]string, error) {
+	var caches []string
+	seen := map[string]bool{}
+	for _, basePth := range basePths {
+		localCaches, err := collectLocalCaches(basePth, packagesDir, excludes)
 		if err != nil {
-			return nuGetCache, fmt.Errorf("error occurred while getting all cache: %s", err)
+			return nil, err
 		}
-		for _, lcItem := range localCaches {
-			nuGetCache.IncludePath(lcItem)
+		for _, pth := range localCaches {
+			if !seen[pth] {
+				seen[pth] = true
+				caches = append(caches, pth)
+			}
 		}
-		nuGetCache.IncludePath(collectGlobalCaches())
 	}
-	return nuGetCache, nil
+	return caches, nil
 }
 
 // collectGlobalCaches collects the global package caches.
+// The global_packages_folder input is applied through the NUGET_PACKAGES env var, so the restores use the same folder.
 func collectGlobalCaches() string {
 	if pth := os.Getenv(cacheEnvGlobal); pth != "" {
 		return pth
@@ -180,63 +607,1069 @@ func collectGlobalCaches() string {
 }
 
 // collectLocalCaches collects the local caches.
-func collectLocalCaches(basePth string) ([]string, error) {
-	var caches []string
+// If the packages are restored into a single packages directory (-PackagesDirectory), only that directory is returned,
+// otherwise the packages folders found under the base path, except the ones matching an exclude pattern.
+func collectLocalCaches(basePth, packagesDir string, excludes []string) ([]string, error) {
+	if packagesDir != "" {
+		return []string{packagesDir}, nil
+	}
+
 	absProjectRoot, err := filepath.Abs(basePth)
 	if err != nil {
 		return []string{}, fmt.Errorf("cache collection failed: failed to determine project root path: %s", err)
 	}
-	if err := filepath.Walk(absProjectRoot, func(path string, f os.FileInfo, err error) error {
-		if f.IsDir() {
-			if f.Name() == "packages" {
-				caches = append(caches, path)
-				return io.EOF
+	caches, err := findPackagesDirs(absProjectRoot, excludes)
+	if err != nil {
+		return []string{}, fmt.Errorf("cache collection failed: failed to determine cache paths: %s", err)
+	}
+
+	return caches, nil
+}
+
+// parseCacheExcludePatterns parses a comma or newline separated list of filepath.Match patterns.
+func parseCacheExcludePatterns(list string) ([]string, error) {
+	var patterns []string
+	for _, field := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' }) {
+		pattern := strings.TrimSpace(field)
+		if pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid cache exclude pattern (%s): %s", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// isExcludedCachePath reports whether the given absolute path, or its path relative to the working directory, matches any of the patterns.
+func isExcludedCachePath(absPth string, patterns []string) bool {
+	candidates := []string{absPth}
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, absPth); err == nil {
+			candidates = append(candidates, rel)
+		}
+	}
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if matched, err := filepath.Match(pattern, candidate); err == nil && matched {
+				return true
 			}
 		}
+	}
+	return false
+}
+
+// isSubPath reports whether pth is located under the root directory.
+func isSubPath(root, pth string) bool {
+	rel, err := filepath.Rel(root, pth)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// clearObjFolders removes the obj folders found under the project root,
+// so a stale obj/project.assets.json can not make the restore skip work.
+func clearObjFolders(basePth string) error {
+	absProjectRoot, err := filepath.Abs(basePth)
+	if err != nil {
+		return fmt.Errorf("failed to determine project root path: %s", err)
+	}
+
+	var objDirs []string
+	if err := filepath.Walk(absProjectRoot, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() && f.Name() == "obj" {
+			objDirs = append(objDirs, path)
+			return filepath.SkipDir
+		}
 		return nil
-	}); err != nil && err != io.EOF {
-		return []string{}, fmt.Errorf("cache collection failed: failed to determine cache paths: %s", err)
+	}); err != nil {
+		return fmt.Errorf("failed to determine obj folders: %s", err)
 	}
 
-	return caches, nil
+	for _, objDir := range objDirs {
+		if !isSubPath(absProjectRoot, objDir) {
+			return fmt.Errorf("obj folder (%s) is outside of the project root (%s)", objDir, absProjectRoot)
+		}
+		if err := os.RemoveAll(objDir); err != nil {
+			return fmt.Errorf("failed to remove (%s): %s", objDir, err)
+		}
+		log.Printf("Cleared: %s", objDir)
+	}
+
+	return nil
+}
+
+// isRestoreArtifact reports whether the given file is a transient restore artifact in an obj folder.
+func isRestoreArtifact(pth string) bool {
+	if filepath.Base(filepath.Dir(pth)) != "obj" {
+		return false
+	}
+	for _, pattern := range restoreArtifactPatterns {
+		if match, err := filepath.Match(pattern, filepath.Base(pth)); err == nil && match {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanRestoreArtifacts removes the transient restore artifacts found under the project root.
+func cleanRestoreArtifacts(basePth string) error {
+	absProjectRoot, err := filepath.Abs(basePth)
+	if err != nil {
+		return fmt.Errorf("failed to determine project root path: %s", err)
+	}
+
+	var artifacts []string
+	if err := filepath.Walk(absProjectRoot, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() && isRestoreArtifact(path) {
+			artifacts = append(artifacts, path)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to determine restore artifacts: %s", err)
+	}
+
+	for _, artifact := range artifacts {
+		if !isSubPath(absProjectRoot, artifact) {
+			return fmt.Errorf("restore artifact (%s) is outside of the project root (%s)", artifact, absProjectRoot)
+		}
+		if err := os.Remove(artifact); err != nil {
+			return fmt.Errorf("failed to remove (%s): %s", artifact, err)
+		}
+		log.Printf("Removed: %s", artifact)
+	}
+
+	return nil
+}
+
+// collectRestoreOutputs returns the restore output files (see restoreOutputPatterns) of the obj folders under the given base paths.
+// Only these files are returned, not the obj folders, which also hold the intermediate build outputs.
+func collectRestoreOutputs(basePths []string) ([]string, error) {
+	seen := map[string]bool{}
+	var outputs []string
+	for _, basePth := range basePths {
+		absProjectRoot, err := filepath.Abs(basePth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine project root path: %s", err)
+		}
+		if err := filepath.Walk(absProjectRoot, func(pth string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if f.IsDir() {
+				if f.Name() == "packages" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Base(filepath.Dir(pth)) != "obj" || seen[pth] {
+				return nil
+			}
+			for _, pattern := range restoreOutputPatterns {
+				if match, err := filepath.Match(pattern, f.Name()); err == nil && match {
+					seen[pth] = true
+					outputs = append(outputs, pth)
+					break
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to determine restore outputs: %s", err)
+		}
+	}
+	return outputs, nil
+}
+
+// restoreFailure is a failed solution restore, with the failure category and exit code the step exits with.
+type restoreFailure struct {
+	category string
+	exitCode int
+	message  string
+}
+
+func (f restoreFailure) Error() string {
+	return f.message
+}
+
+func newRestoreFailure(category string, format string, v ...interface{}) restoreFailure {
+	return restoreFailure{category: category, exitCode: 1, message: fmt.Sprintf(format, v...)}
+}
+
+// restoreSolution prepares and restores the configs.XamarinSolution solution.
+// It returns the restore output and the restore duration, errors are returned as restoreFailure.
+func restoreSolution(configs ConfigsModel, nuGetRestoreCmdArgs, restoreEnvs []string) (string, time.Duration, error) {
+	solutionDir := solutionDirOf(configs.XamarinSolution)
+
+	if configs.CheckTargetFrameworks {
+		fmt.Println()
+		log.Infof("Checking target frameworks...")
+		if err := checkTargetFrameworks(solutionDir); err != nil {
+			log.Warnf("Failed to check target frameworks: %s", err)
+		}
+	}
+
+	// Only nuget.exe may skip the PackageReference projects, the other restore tools run MSBuild's Restore target.
+	if configs.RestoreTool == restoreToolNuGet {
+		styles, err := scanRestoreStyles(solutionDir)
+		if err != nil {
+			log.Warnf("%s", err)
+		} else if styles.mixed() && configs.StrictRestoreStyle {
+			return "", 0, newRestoreFailure(failureCategoryInput, "%s", mixedRestoreStyleMessage(styles))
+		} else if styles.mixed() {
+			fmt.Println()
+			log.Warnf("%s", mixedRestoreStyleMessage(styles))
+		}
+	}
+
+	if configs.ValidateSourceMapping {
+		fmt.Println()
+		log.Infof("Validating package source mapping...")
+		configPth := configs.NuGetConfigFile
+		if configPth == "" {
+			pth, err := findNuGetConfig(solutionDir)
+			if err != nil {
+				return "", 0, newRestoreFailure(failureCategoryInput, "failed to look up NuGet.Config: %s", err)
+			}
+			configPth = pth
+		}
+		if configPth == "" {
+			log.Printf("No NuGet.Config found for %s", solutionDir)
+		} else {
+			var proxyURL *url.URL
+			if configs.HTTPProxy != "" {
+				// A malformed proxy is rejected at the input validation.
+				proxyURL, _ = url.Parse(configs.HTTPProxy)
+			}
+			if err := validateSourceMapping(configPth, solutionDir, newHTTPClient(preflightTimeout, proxyURL)); err != nil {
+				return "", 0, newRestoreFailure(failureCategoryInput, "%s", err)
+			}
+		}
+	}
+
+	if configs.ClearObj {
+		fmt.Println()
+		log.Infof("Clearing obj folders...")
+		if err := clearObjFolders(solutionDir); err != nil {
+			return "", 0, newRestoreFailure(failureCategoryUnknown, "Failed to clear obj folders: %s", err)
+		}
+	}
+
+	if configs.CleanRestoreArtifacts {
+		fmt.Println()
+		log.Infof("Cleaning restore artifacts...")
+		if err := cleanRestoreArtifacts(solutionDir); err != nil {
+			return "", 0, newRestoreFailure(failureCategoryUnknown, "Failed to clean restore artifacts: %s", err)
+		}
+	}
+
+	if configs.LogSources {
+		fmt.Println()
+		log.Infof("Listing package sources...")
+		if err := logSources(configs.RestoreTool, nuGetRestoreCmdArgs, solutionDir); err != nil {
+			log.Warnf("Failed to list package sources: %s", err)
+		}
+	}
+
+	fmt.Println()
+	log.Infof("Restoring NuGet packages...")
+	if configs.NuGetConfigFile != "" {
+		log.Printf("Using NuGet config file: %s", configs.NuGetConfigFile)
+	}
+
+	restoreCmds, err := buildRestoreCommands(configs, nuGetRestoreCmdArgs)
+	if err != nil {
+		return "", 0, newRestoreFailure(failureCategoryInput, "%s", err)
+	}
+
+	if isPaketRepo(solutionDir) {
+		if configs.SupportPaket {
+			log.Printf("Found %s, restoring with Paket", paketDependenciesFile)
+			paketCmd, err := paketRestoreCommand(solutionDir)
+			if err != nil {
+				return "", 0, newRestoreFailure(failureCategoryRestore, "Paket restore failed: %s", err)
+			}
+			restoreCmds = []restoreCommand{paketCmd}
+		} else {
+			log.Warnf("Found %s, the dependencies are managed by Paket, which is not restored by %s", paketDependenciesFile, configs.RestoreTool)
+			log.Warnf("Enable the support_paket input to restore with Paket")
+		}
+	}
+
+	var lockFilesBefore map[string]bool
+	if configs.FailOnNewLockFile {
+		lockFilesBefore, err = collectLockFiles(solutionDir)
+		if err != nil {
+			return "", 0, newRestoreFailure(failureCategoryUnknown, "Failed to check lock files: %s", err)
+		}
+	}
+
+	timeout := restoreTimeout(configs, solutionDir)
+
+	// The solution's packages folder (packages.config projects) and the global packages folder (PackageReference projects)
+	// are restored into staging copies, which replace the real folders only if every restore command succeeded.
+	var stagedDirs []stagedDir
+	discardStagedDirs := func() {
+		for _, d := range stagedDirs {
+			d.discard()
+		}
+	}
+	if configs.AtomicRestore {
+		fmt.Println()
+		log.Infof("Staging packages folders...")
+		localTarget := configs.PackagesDirectory
+		if localTarget == "" && configs.SolutionDirectory != "" {
+			localTarget = filepath.Join(configs.SolutionDirectory, "packages")
+		} else if localTarget == "" {
+			localTarget = filepath.Join(solutionDir, "packages")
+		}
+		for _, target := range []string{localTarget, collectGlobalCaches()} {
+			staged, err := stageDir(target)
+			if err != nil {
+				discardStagedDirs()
+				return "", 0, newRestoreFailure(failureCategoryUnknown, "Failed to stage packages folder: %s", err)
+			}
+			log.Printf("Staging %s in %s", staged.target, staged.staging)
+			stagedDirs = append(stagedDirs, staged)
+		}
+
+		localStaging, globalStaging := stagedDirs[0].staging, stagedDirs[1].staging
+		for i, restoreCmd := range restoreCmds {
+			if restoreCmd.tool == restoreToolNuGet {
+				restoreCmds[i].args = withPackagesDirectory(restoreCmd.args, localStaging)
+			}
+		}
+		restoreEnvs = append(append([]string{}, restoreEnvs...), cacheEnvGlobal+"="+globalStaging)
+	}
+
+	// Every restore command runs even if a previous one failed, the restore fails if any of them failed.
+	runOpts := restoreRunOptions{
+		envs:               restoreEnvs,
+		timeout:            timeout,
+		retryErrorCodes:    parseErrorCodes(configs.RetryErrorCodes),
+		retryCount:         uint(configs.RestoreRetryCount),
+		retryWait:          time.Duration(configs.RestoreRetryWait) * time.Second,
+		retryMaxWait:       time.Duration(configs.RestoreRetryMaxWait) * time.Second,
+		retryJitterPercent: configs.RetryJitterPercent,
+	}
+	restoreStart := time.Now()
+	var outputs, restoreErrs []string
+	restoreExitCode := 0
+	for _, restoreCmd := range restoreCmds {
+		output, err := runRestoreCommand(restoreCmd, runOpts)
+		outputs = append(outputs, output)
+		if err != nil {
+			log.Errorf("%s restore failed: %s", restoreCmd.tool, err)
+			restoreErrs = append(restoreErrs, fmt.Sprintf("%s: %s", restoreCmd.tool, err))
+			if restoreExitCode == 0 {
+				restoreExitCode = exitCode(err)
+			}
+		}
+	}
+	restoreDuration := time.Since(restoreStart)
+	output := strings.Join(outputs, "\n")
+	if len(restoreErrs) > 0 {
+		discardStagedDirs()
+		if configs.GroupErrorsByProject {
+			fmt.Println()
+			log.Infof("Restore errors by project:")
+			logDiagnosticsByProject(output)
+		}
+		if configs.LockedMode {
+			packagesConfigProjects, err := hasPackagesConfig(solutionDir)
+			if err != nil {
+				log.Warnf("%s", err)
+			}
+			logLockedModeHints(output, packagesConfigProjects)
+		}
+		logRestoreHints(output)
+		failure := newRestoreFailure(failureCategoryRestore, "NuGet restore failed: %s", strings.Join(restoreErrs, ", "))
+		failure.exitCode = restoreExitCode
+		return output, restoreDuration, failure
+	}
+	for _, d := range stagedDirs {
+		if err := d.commit(); err != nil {
+			return output, restoreDuration, newRestoreFailure(failureCategoryUnknown, "Failed to swap the restored packages folder into place: %s", err)
+		}
+		log.Printf("Restored packages moved into %s", d.target)
+	}
+
+	if configs.FailOnNewLockFile {
+		lockFilesAfter, err := collectLockFiles(solutionDir)
+		if err != nil {
+			return output, restoreDuration, newRestoreFailure(failureCategoryUnknown, "Failed to check lock files: %s", err)
+		}
+		if created := newLockFiles(lockFilesBefore, lockFilesAfter); len(created) > 0 {
+			for _, pth := range created {
+				log.Errorf("New lock file: %s", pth)
+			}
+			return output, restoreDuration, newRestoreFailure(failureCategoryRestore, "The restore created %d new %s file(s), commit them to the repository", len(created), nuGetLockFile)
+		}
+	}
+
+	if configs.PrintDependencyTree {
+		fmt.Println()
+		log.Infof("Printing dependency tree...")
+		printDependencyTree(restoreCmds, configs.XamarinSolution)
+	}
+
+	if configs.PerPackageTiming {
+		fmt.Println()
+		log.Infof("Collecting per package timings...")
+		logPackageTimings(output)
+	}
+
+	return output, restoreDuration, nil
+}
+
+// printDryRun prints the restore commands of the targets, without running them.
+func printDryRun(configs ConfigsModel, targets []restoreTarget, nuGetRestoreCmdArgs []string) {
+	fmt.Println()
+	log.Infof("Dry run, the restore commands are printed but not run:")
+	for _, target := range targets {
+		restoreCmds, err := buildRestoreCommands(target.configs(configs), nuGetRestoreCmdArgs)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+		for _, restoreCmd := range restoreCmds {
+			log.Printf("$ %s", printableRestoreArgs(restoreCmd.args))
+		}
+	}
 }
 
 func main() {
 	var configs ConfigsModel
-	if err := stepconf.Parse(&configs); err != nil {
-		fail("Issue with input: %s", err)
+	parseErr := stepconf.Parse(&configs)
+
+	// The failure reason file is cleared first, so a reason left by a previous run is never reported.
+	if configs.FailureReasonPath != "" {
+		if err := writeFailureReason(configs.FailureReasonPath, "", ""); err != nil {
+			log.Warnf("Failed to clear failure reason file: %s", err)
+		} else {
+			failureReasonPath = configs.FailureReasonPath
+		}
+	}
+	summaryOutputPath = configs.SummaryOutputPath
+
+	if parseErr != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", parseErr)
+	}
+	cacheLevel, err := resolveCacheLevel(configs.CacheLevel)
+	if err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+	}
+	configs.CacheLevel = cacheLevel
+
+	if configs.VerifyAuthenticode && configs.AuthenticodeSigner == "" {
+		failWithCategory(failureCategoryInput, "Issue with input: authenticode_signer is required if verify_authenticode is enabled")
+	}
+	if configs.SignerThumbprint != "" {
+		if err := validateThumbprint(configs.SignerThumbprint); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: invalid signer_thumbprint: %s", err)
+		}
+	}
+	if configs.NuGetChecksum != "" && !sha256Pattern.MatchString(configs.NuGetChecksum) {
+		failWithCategory(failureCategoryInput, "Issue with input: nuget_checksum (%s) is not a hex encoded SHA-256 checksum", configs.NuGetChecksum)
+	}
+	if configs.NuGetConfigFile != "" {
+		absConfigFile, err := filepath.Abs(configs.NuGetConfigFile)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to determine nuget_config_file path: %s", err)
+		}
+		if info, err := os.Stat(absConfigFile); err != nil || info.IsDir() {
+			failWithCategory(failureCategoryInput, "Issue with input: nuget_config_file (%s) does not exist or is not a file", absConfigFile)
+		}
+		configs.NuGetConfigFile = absConfigFile
+	}
+	if configs.PackagesDirectory != "" {
+		absPackagesDir, err := filepath.Abs(configs.PackagesDirectory)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to determine packages_directory path: %s", err)
+		}
+		configs.PackagesDirectory = absPackagesDir
+	}
+	if configs.GlobalPackagesFolder != "" {
+		absGlobalPackagesFolder, err := filepath.Abs(configs.GlobalPackagesFolder)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to determine global_packages_folder path: %s", err)
+		}
+		if err := os.MkdirAll(absGlobalPackagesFolder, 0755); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to create global_packages_folder (%s): %s", absGlobalPackagesFolder, err)
+		}
+		if err := os.Setenv(cacheEnvGlobal, absGlobalPackagesFolder); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to set %s: %s", cacheEnvGlobal, err)
+		}
+		configs.GlobalPackagesFolder = absGlobalPackagesFolder
+	}
+	if configs.NoHTTPCache && configs.VendoredNuGetPath == "" && configs.NuGetPath == "" {
+		if major, ok := nuGetMajorVersion(configs.NuGetVersion); ok && major < minNoHTTPCacheMajorVersion {
+			log.Warnf("no_http_cache passes -NoHttpCache, which NuGet %s may not support, it is available since NuGet %d", configs.NuGetVersion, minNoHTTPCacheMajorVersion)
+		}
+	}
+	if configs.DownloadDir != "" {
+		downloadDir, err := prepareDownloadDir(configs.DownloadDir)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+		configs.DownloadDir = downloadDir
+	}
+	if configs.MSBuildPath != "" {
+		absMSBuildPath, err := filepath.Abs(configs.MSBuildPath)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to determine msbuild_path: %s", err)
+		}
+		if exist, err := pathutil.IsPathExists(absMSBuildPath); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to check if msbuild_path (%s) exists: %s", absMSBuildPath, err)
+		} else if !exist {
+			failWithCategory(failureCategoryInput, "Issue with input: msbuild_path (%s) does not exist", absMSBuildPath)
+		}
+		configs.MSBuildPath = absMSBuildPath
+		if configs.MSBuildVersion != "" {
+			log.Warnf("msbuild_version is ignored by NuGet, msbuild_path is set")
+		}
+	}
+	if configs.SolutionDirectory != "" {
+		absSolutionDir, err := filepath.Abs(configs.SolutionDirectory)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to determine solution_directory path: %s", err)
+		}
+		if info, err := os.Stat(absSolutionDir); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: solution_directory (%s) does not exist: %s", absSolutionDir, err)
+		} else if !info.IsDir() {
+			failWithCategory(failureCategoryInput, "Issue with input: solution_directory (%s) is not a directory", absSolutionDir)
+		}
+		configs.SolutionDirectory = absSolutionDir
+	}
+	var proxyURL *url.URL
+	if configs.HTTPProxy != "" {
+		if err := validateSourceURL(configs.HTTPProxy); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: invalid http_proxy: %s", redactSourceCredentials(err.Error()))
+		}
+		proxyURL, _ = url.Parse(configs.HTTPProxy)
+	}
+	if configs.RestoreRetryMaxWait < configs.RestoreRetryWait {
+		failWithCategory(failureCategoryInput, "Issue with input: restore_retry_max_wait (%d) is less than restore_retry_wait (%d)", configs.RestoreRetryMaxWait, configs.RestoreRetryWait)
+	}
+	if configs.NuGetDownloadBaseURL != "" {
+		if err := validateSourceURL(configs.NuGetDownloadBaseURL); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: invalid nuget_download_base_url: %s", err)
+		}
+	}
+	cacheExcludes, err := parseCacheExcludePatterns(configs.CacheExcludePaths)
+	if err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+	}
+	if configs.RestorableExtensions == "" {
+		configs.RestorableExtensions = defaultRestorableExtensions
+	}
+	restorableExts, err := parseRestorableExtensions(configs.RestorableExtensions)
+	if err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+	}
+	if strings.TrimSpace(configs.XamarinSolution) == "" {
+		root := os.Getenv(sourceDirEnvKey)
+		if root == "" {
+			root = "."
+		}
+		solution, err := discoverSolution(root)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: xamarin_solution is empty and %s", err)
+		}
+		log.Printf("Discovered solution: %s", solution)
+		configs.XamarinSolution = solution
+	}
+	solutions, err := resolveSolutionList(configs.XamarinSolution, restorableExts)
+	if err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+	}
+	stepSummary.Solutions = solutions
+	switch {
+	case len(solutions) == 0 && configs.AllowNoSolutions:
+		log.Warnf("No solution matches %s, nothing to restore", configs.XamarinSolution)
+		exportRestoreStatus(restoreStatusSuccess)
+		writeStepSummary(restoreStatusSuccess)
+		os.Exit(0)
+	case len(solutions) == 0:
+		failWithCategory(failureCategoryInput, "Issue with input: no solution matches %s, enable allow_no_solutions to skip the restore instead", configs.XamarinSolution)
+	}
+	changedFiles, err := parseChangedFiles(configs.ChangedFiles)
+	if err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+	}
+	targets, err := resolveRestoreTargets(solutions, changedFiles, restorableExts)
+	if err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+	}
+	if len(changedFiles) > 0 {
+		for _, target := range targets {
+			if target.solutionDir != "" {
+				log.Printf("Changed project: %s", target.path)
+			} else {
+				log.Printf("No changed project determined, restoring the whole solution: %s", target.path)
+			}
+		}
+	}
+	// The inputs relative to the solution's directory are resolved from the first solution.
+	configs.XamarinSolution = solutions[0]
+
+	if configs.MirrorSource != "" {
+		if err := validateSourceURL(configs.MirrorSource); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+	}
+
+	if configs.RestoreOutputDir != "" {
+		outputDir, err := prepareRestoreOutputDir(configs.RestoreOutputDir, solutionDirOf(configs.XamarinSolution))
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+		configs.RestoreOutputDir = outputDir
+	}
+	if _, err := parseSourceList(configs.NuGetSources); err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: invalid nuget_sources: %s", err)
+	}
+
+	if configs.RestoreTool == restoreToolAuto {
+		restoreTool, err := resolveAutoRestoreTool(solutions)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: failed to detect the restore tool: %s", err)
+		}
+		log.Printf("Detected restore tool: %s", restoreTool)
+		configs.RestoreTool = restoreTool
+	}
+
+	if configs.RestoreOutputDir != "" && configs.RestoreTool == restoreToolNuGet {
+		log.Warnf("restore_output_dir is only applied to the dotnet and msbuild restores, set restore_tool to %s, %s or %s", restoreToolDotnet, restoreToolBoth, restoreToolMSBuild)
+	} else if configs.RestoreOutputDir != "" {
+		if err := checkRestoreOutputTargets(targets); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+	}
+
+	var feeds []feedSource
+	if configs.FeedCredentialsJSON != "" {
+		if feeds, err = parseFeedCredentials(string(configs.FeedCredentialsJSON)); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+	}
+	var privateFeeds []feedSource
+	if configs.PrivateFeeds != "" {
+		if configs.NuGetConfigFile != "" {
+			failWithCategory(failureCategoryInput, "Issue with input: private_feeds and nuget_config_file can not be set together, the private feeds are restored with a generated NuGet.Config")
+		}
+		if privateFeeds, err = parsePrivateFeeds(string(configs.PrivateFeeds)); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: invalid private_feeds: %s", err)
+		}
+	}
+	if configs.AzureFeedEndpoints != "" {
+		if err := validateFeedEndpoints(string(configs.AzureFeedEndpoints)); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: invalid azure_feed_endpoints: %s", err)
+		}
+	}
+	if packageSource, ok, err := newPackageSource(configs.PackageSourceURL, configs.PackageSourceUsername, string(configs.PackageSourcePassword)); err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+	} else if ok {
+		feeds = append(feeds, packageSource)
+	}
+	if gitHubSource, ok, err := newGitHubPackagesSource(configs.GitHubPackagesOwner, string(configs.GitHubPackagesToken)); err != nil {
+		failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+	} else if ok {
+		feeds = append(feeds, gitHubSource)
+	}
+	if len(privateFeeds) > 0 && len(feeds) > 0 {
+		failWithCategory(failureCategoryInput, "Issue with input: private_feeds can not be combined with feed_credentials_json, package_source_url or github_packages_owner, the restore uses the generated NuGet.Config, which ignores the feeds added to the user level NuGet config")
 	}
 
 	fmt.Println()
 	configs.print()
 
-	nuGetPth := "/Library/Frameworks/Mono.framework/Versions/Current/bin/nuget"
+	if configs.MirrorSource != "" {
+		fmt.Println()
+		log.Infof("Checking mirror feed protocol...")
+		if err := checkFeedProtocol(configs.MirrorSource, configs.MirrorProtocol, configs.RestoreTool); err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+	}
+
+	var credentials netrc
+	if configs.UseNetrc {
+		fmt.Println()
+		log.Infof("Loading netrc credentials...")
+		if credentials, err = loadNetrc(); err != nil {
+			log.Warnf("Continuing without netrc credentials: %s", err)
+		}
+	}
+
+	var phases []phaseTiming
+	downloadStart := time.Now()
+
+	fmt.Println()
+	log.Infof("Resolving NuGet and Mono...")
+	monoPath = resolveTool("mono", constants.MonoPath)
+	nuGetPth := resolveTool("nuget", monoFrameworkNuGetPath)
 	nuGetRestoreCmdArgs := []string{nuGetPth}
-	if configs.NuGetVersion != "" {
-		downloadPth, err := downloadNuGet(configs.NuGetVersion)
+	// nuGetVersionUsed is the concrete version of the NuGet running the restore, resolved from the binary if unknown.
+	nuGetVersionUsed, nuGetVersionUnknown := "", false
+	if configs.NuGetPath != "" && !usesNuGetExe(configs.RestoreTool) {
+		log.Warnf("nuget_path is ignored, the %s restore tool does not use NuGet", configs.RestoreTool)
+	} else if configs.NuGetPath != "" {
+		fmt.Println()
+		log.Infof("Using system NuGet...")
+		if configs.NuGetVersion != "" {
+			log.Warnf("nuget_version is ignored, nuget_path is set")
+		}
+		if configs.VendoredNuGetPath != "" {
+			log.Warnf("vendored_nuget_path is ignored, nuget_path is set")
+		}
+		systemNuGetPth, err := validateSystemNuGet(configs.NuGetPath)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+		log.Printf("System NuGet: %s", systemNuGetPth)
+		nuGetRestoreCmdArgs = []string{systemNuGetPth}
+	} else if configs.VendoredNuGetPath != "" && !usesNuGetExe(configs.RestoreTool) {
+		log.Warnf("vendored_nuget_path is ignored, the %s restore tool does not use NuGet", configs.RestoreTool)
+	} else if configs.VendoredNuGetPath != "" {
+		fmt.Println()
+		log.Infof("Using vendored NuGet...")
+		if configs.NuGetVersion != "" {
+			log.Printf("nuget_version is ignored, vendored_nuget_path is set")
+		}
+		nuGetExePth, err := prepareVendoredNuGet(configs.VendoredNuGetPath, configs.NuGetChecksum)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+		log.Printf("Vendored NuGet: %s", nuGetExePth)
+		if configs.VerifyAuthenticode && !configs.DryRun {
+			fmt.Println()
+			log.Infof("Verifying NuGet Authenticode signature...")
+			if err := verifyAuthenticode(nuGetExePth, configs.AuthenticodeSigner, configs.SignerThumbprint); err != nil {
+				failWithCategory(failureCategoryDownload, "%s", err)
+			}
+		}
+		nuGetRestoreCmdArgs = []string{monoPath, nuGetExePth}
+	} else if configs.NuGetVersion != "" && !usesNuGetExe(configs.RestoreTool) {
+		log.Warnf("nuget_version is ignored, the %s restore tool does not use NuGet", configs.RestoreTool)
+	} else if configs.NuGetVersion != "" && configs.DryRun {
+		log.Printf("Dry run, NuGet %s is not downloaded", configs.NuGetVersion)
+		nuGetRestoreCmdArgs = []string{monoPath, fmt.Sprintf("<nuget.exe %s>", configs.NuGetVersion)}
+	} else if configs.NuGetVersion != "" {
+		nuGetExePth, err := EnsureNuGet(configs.NuGetVersion, NuGetOptions{
+			CacheDir:           nuGetCacheDir(),
+			Timeout:            time.Duration(configs.DownloadTimeout) * time.Second,
+			Proxy:              proxyURL,
+			DownloadBaseURL:    configs.NuGetDownloadBaseURL,
+			DownloadDir:        configs.DownloadDir,
+			RetryCount:         uint(configs.DownloadRetryCount),
+			Checksum:           configs.NuGetChecksum,
+			Credentials:        credentials,
+			RetryJitterPercent: configs.RetryJitterPercent,
+			PreflightCheck:     configs.PreflightCheck,
+		})
+		if err != nil && configs.FallbackToSystemNuGet {
+			log.Warnf("%s", err)
+			log.Warnf("Falling back to the system NuGet: %s", strings.Join(nuGetRestoreCmdArgs, " "))
+		} else if err != nil {
+			failWithCategory(failureCategoryDownload, "%s", err)
+		} else {
+			// The signature is verified before the binary is run for the first time, including the version probe.
+			if configs.VerifyAuthenticode {
+				fmt.Println()
+				log.Infof("Verifying NuGet Authenticode signature...")
+				if err := verifyAuthenticode(nuGetExePth, configs.AuthenticodeSigner, configs.SignerThumbprint); err != nil {
+					failWithCategory(failureCategoryDownload, "%s", err)
+				}
+			}
+			nuGetRestoreCmdArgs = []string{monoPath, nuGetExePth}
+
+			if !isFloatingNuGetVersion(configs.NuGetVersion) {
+				nuGetVersionUsed = configs.NuGetVersion
+			} else if resolvedVersion, err := resolveNuGetVersion(nuGetRestoreCmdArgs); err != nil {
+				log.Warnf("Failed to resolve NuGet %s version: %s", configs.NuGetVersion, err)
+				log.Printf("Using NuGet %s (version unknown)", configs.NuGetVersion)
+				nuGetVersionUnknown = true
+			} else {
+				log.Printf("Resolved %s to v%s", configs.NuGetVersion, strings.TrimPrefix(resolvedVersion, "v"))
+				nuGetVersionUsed = resolvedVersion
+				if err := tools.ExportEnvironmentWithEnvman(resolvedVersionEnvKey, resolvedVersion); err != nil {
+					log.Warnf("Failed to export %s: %s", resolvedVersionEnvKey, err)
+				}
+			}
+		}
+	}
+
+	if usesNuGetExe(configs.RestoreTool) && !configs.DryRun {
+		if nuGetVersionUsed == "" && !nuGetVersionUnknown {
+			version, err := resolveNuGetVersion(nuGetRestoreCmdArgs)
+			if err != nil {
+				log.Warnf("Failed to determine the NuGet version: %s", err)
+			} else {
+				log.Printf("NuGet version: %s", version)
+				nuGetVersionUsed = version
+			}
+		}
+		if nuGetVersionUsed != "" {
+			stepSummary.NuGetVersion = nuGetVersionUsed
+			if err := tools.ExportEnvironmentWithEnvman(versionUsedEnvKey, nuGetVersionUsed); err != nil {
+				log.Warnf("Failed to export %s: %s", versionUsedEnvKey, err)
+			}
+		}
+	}
+
+	if configs.VerifyAuthenticode && !configs.DryRun && usesNuGetExe(configs.RestoreTool) && len(nuGetRestoreCmdArgs) < 2 {
+		log.Warnf("Only a downloaded or vendored nuget.exe is verified, the Authenticode signature of %s is not verified", nuGetRestoreCmdArgs[0])
+	}
+
+	phases = append(phases, phaseTiming{name: "download", duration: time.Since(downloadStart)})
+
+	if configs.DryRun {
+		printDryRun(configs, targets, nuGetRestoreCmdArgs)
+		os.Exit(0)
+	}
+
+	if configs.PackagesArchive != "" {
+		targetDir := configs.PackagesArchiveTarget
+		if targetDir == "" {
+			targetDir = collectGlobalCaches()
+		}
+
+		fmt.Println()
+		log.Infof("Extracting packages archive...")
+		count, err := extractPackagesArchive(configs.PackagesArchive, targetDir)
 		if err != nil {
-			fail("%s", err)
+			fail("Failed to extract packages archive: %s", err)
 		}
-		nuGetRestoreCmdArgs = []string{constants.MonoPath, downloadPth}
+		log.Printf("Extracted %d files from %s to %s", count, configs.PackagesArchive, targetDir)
 	}
 
-	fmt.Println()
-	log.Infof("Restoring NuGet packages...")
+	var restoreEnvs []string
+	if configs.ForceEnglishOutput {
+		restoreEnvs = append(restoreEnvs, englishOutputEnvs...)
+	}
+	if len(credentials) > 0 {
+		fmt.Println()
+		log.Infof("Applying netrc credentials to the package sources...")
+		envs, err := netrcSourceCredentialEnvs(nuGetRestoreCmdArgs, credentials)
+		if err != nil {
+			log.Warnf("Failed to apply netrc credentials: %s", err)
+		}
+		restoreEnvs = append(restoreEnvs, envs...)
+	}
+
+	if configs.HTTPProxy != "" {
+		// nuget.exe, dotnet and msbuild read the proxy from the environment.
+		for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+			restoreEnvs = append(restoreEnvs, key+"="+configs.HTTPProxy)
+		}
+	}
+
+	if configs.AzureCredProvider {
+		fmt.Println()
+		log.Infof("Installing Azure Artifacts credential provider...")
+		pluginsDir, err := installAzureCredentialProvider(newHTTPClient(defaultDownloadTimeout, proxyURL), credentials)
+		if err != nil {
+			failWithCategory(failureCategoryDownload, "Failed to install the Azure Artifacts credential provider: %s", err)
+		}
+		if os.Getenv(nuGetPluginPathsEnv) != "" || configs.CredentialProviderDir != "" {
+			log.Warnf("%s is set, NuGet only discovers the credential provider in %s if it is listed there", nuGetPluginPathsEnv, pluginsDir)
+		}
+	}
+	if configs.AzureFeedEndpoints != "" {
+		restoreEnvs = append(restoreEnvs, vssFeedEndpointsEnv+"="+string(configs.AzureFeedEndpoints))
+		log.Printf("Set %s for the restore", vssFeedEndpointsEnv)
+	}
+
+	if configs.CredentialProviderDir != "" || os.Getenv(nuGetPluginPathsEnv) != "" {
+		fmt.Println()
+		log.Infof("Discovering credential providers...")
+		envs, err := credentialProviderEnvs(configs.CredentialProviderDir)
+		if err != nil {
+			failWithCategory(failureCategoryInput, "Issue with input: %s", err)
+		}
+		restoreEnvs = append(restoreEnvs, envs...)
+	}
+
+	if len(feeds) > 0 {
+		fmt.Println()
+		log.Infof("Adding private feeds...")
+		if err := addPrivateFeeds(configs.RestoreTool, nuGetRestoreCmdArgs, feeds); err != nil {
+			fail("Failed to add private feeds: %s", err)
+		}
+	}
+
+	if len(privateFeeds) > 0 {
+		fmt.Println()
+		log.Infof("Generating NuGet.Config for the private feeds...")
+		pth, err := writeNuGetConfig(privateFeeds)
+		if err != nil {
+			fail("Failed to generate NuGet.Config: %s", err)
+		}
+		for _, feed := range privateFeeds {
+			log.Printf("Added package source %s: %s", feed.name, feed.url)
+		}
+		log.Printf("Using generated NuGet config file: %s", pth)
+		configs.NuGetConfigFile = pth
+	}
+
+	if configs.ClearLocalCaches {
+		fmt.Println()
+		log.Infof("Clearing the NuGet local caches...")
+		log.Printf("Clearing the global packages folder, the HTTP cache, the temp and the plugins cache folders")
+		if err := clearNuGetLocals(configs.RestoreTool, nuGetRestoreCmdArgs, nuGetLocalsAll); err != nil {
+			fail("Failed to clear the NuGet local caches: %s", err)
+		}
+	} else if configs.CleanGlobalCache {
+		fmt.Println()
+		log.Infof("Clearing the global packages folder...")
+		if configs.CacheLevel == cacheInputGlobal || configs.CacheLevel == cacheInputAll {
+			log.Warnf("The cache level is %s, the global packages folder restored from scratch is what gets cached", configs.CacheLevel)
+		}
+		if err := clearNuGetLocals(configs.RestoreTool, nuGetRestoreCmdArgs, nuGetLocalsGlobalPackages); err != nil {
+			fail("Failed to clear the global packages folder: %s", err)
+		}
+	}
+
+	if configs.PreflightCheck && configs.MirrorSource != "" {
+		fmt.Println()
+		log.Infof("Checking mirror connectivity...")
+		if err := checkConnectivity(newHTTPClient(preflightTimeout, proxyURL), configs.MirrorSource); err != nil {
+			failWithCategory(failureCategoryRestore, "%s", err)
+		}
+	}
+
+	// Every solution is restored even if a previous one failed, unless fail_fast is enabled, the step fails if any of them failed.
+	var outputs, failedSolutions []string
+	var firstFailure *restoreFailure
+	var restoreDuration time.Duration
+	succeeded := 0
+	for i, target := range targets {
+		solution := target.path
+		fmt.Println()
+		log.Infof("Restoring solution (%d/%d): %s", i+1, len(targets), solution)
 
-	nuGetRestoreCmdArgs = append(nuGetRestoreCmdArgs, "restore", configs.XamarinSolution)
-	if err := runRestoreCommand(nuGetRestoreCmdArgs); err != nil {
-		fail("NuGet restore failed: %s", err)
+		output, duration, err := restoreSolution(target.configs(configs), nuGetRestoreCmdArgs, restoreEnvs)
+		outputs = append(outputs, output)
+		restoreDuration += duration
+		if err == nil {
+			succeeded++
+			continue
+		}
+
+		failure, ok := err.(restoreFailure)
+		if !ok {
+			failure = newRestoreFailure(failureCategoryUnknown, "%s", err)
+		}
+		log.Errorf("Restore of %s failed: %s", solution, failure)
+		failedSolutions = append(failedSolutions, solution)
+		if firstFailure == nil {
+			firstFailure = &failure
+		}
+		if configs.FailFast {
+			break
+		}
+	}
+
+	runCleanups()
+	phases = append(phases, phaseTiming{name: "restore", duration: restoreDuration})
+	stepSummary.DurationSeconds = restoreDuration.Seconds()
+	exportSolutionCounts(succeeded, len(failedSolutions))
+
+	if firstFailure != nil {
+		if len(targets) == 1 {
+			failWithExitCode(firstFailure.category, firstFailure.exitCode, "%s", firstFailure.message)
+		}
+		failWithExitCode(firstFailure.category, firstFailure.exitCode, "Restore of %d solution(s) failed: %s, first error: %s", len(failedSolutions), strings.Join(failedSolutions, ", "), firstFailure.message)
+	}
+	exportRestoreSummary(strings.Join(outputs, "\n"))
+
+	var solutionDirs []string
+	for _, solution := range solutions {
+		solutionDirs = append(solutionDirs, solutionDirOf(solution))
+	}
+
+	if configs.SBOMOutputPath != "" {
+		fmt.Println()
+		log.Infof("Writing SBOM...")
+		count, err := writeSBOM(configs.SBOMOutputPath, solutionDirs, collectGlobalCaches())
+		if err != nil {
+			log.Warnf("Failed to write SBOM: %s", err)
+		} else {
+			log.Printf("Written %d component(s) to %s", count, configs.SBOMOutputPath)
+		}
 	}
 
 	// Collecting caches
 	fmt.Println()
 	log.Infof("Collecting NuGet cache...")
-	caches, err := collectCaches(configs.CacheLevel, path.Dir(configs.XamarinSolution))
+	cacheStart := time.Now()
+	cacheIndicator := ""
+	if configs.CacheLevel != cacheInputNone {
+		if cacheIndicator, err = writeCacheIndicator(solutionDirs); err != nil {
+			log.Warnf("Failed to hash the dependency files, the cache is not keyed to them: %s", err)
+		} else if cacheIndicator != "" {
+			log.Printf("Cache keyed to the %s and %s files by: %s", packagesConfigFile, nuGetLockFile, cacheIndicator)
+		}
+	}
+	var cached cachedPaths
+	candidates, err := collectCacheCandidates(configs.CacheLevel, solutionDirs, configs.PackagesDirectory, cacheExcludes)
 	if err != nil {
+		if configs.FailOnCacheError {
+			fail("Cache collection failed: %s", err)
+		}
 		log.Warnf("Cache collection failed: %s", err)
 	} else {
+		candidates.restoreOutputDir = configs.RestoreOutputDir
+		if configs.NuGetVersion != "" && !isFloatingNuGetVersion(configs.NuGetVersion) {
+			candidates.nuGetBinariesDir = nuGetCacheDir()
+		}
+		if configs.CacheRestoreArtifacts && (configs.CacheLevel == cacheInputlocal || configs.CacheLevel == cacheInputAll) {
+			restoreOutputs, err := collectRestoreOutputs(solutionDirs)
+			if err != nil {
+				log.Warnf("Failed to collect the restore artifacts: %s", err)
+			}
+			candidates.restoreArtifacts = restoreOutputs
+			log.Printf("Caching %d restore artifact(s) of the obj folders", len(restoreOutputs))
+		}
+		cached = selectCachedPaths(configs.CacheLevel, candidates)
+		stepSummary.CachePaths = cached.count()
+		caches := newNuGetCache(cached.all(), cacheIndicator, candidates.restoreOutputDir, candidates.nuGetBinariesDir)
 		if err := caches.Commit(); err != nil {
+			if configs.FailOnCacheError {
+				fail("Cache collection failed: failed to commit cache paths: %s", err)
+			}
 			log.Warnf("Cache collection failed: failed to commit cache paths: %s", err)
+		} else if err := tools.ExportEnvironmentWithEnvman(cachedPathsEnvKey, strings.Join(cached.all(), "\n")); err != nil {
+			log.Warnf("Failed to export %s: %s", cachedPathsEnvKey, err)
 		}
 	}
+	phases = append(phases, phaseTiming{name: "cache", duration: time.Since(cacheStart)})
+
+	fmt.Println()
+	summary := fmt.Sprintf("Restore finished in %s, cached %d paths (local: %d, global: %d)", restoreDuration.Round(time.Second), cached.count(), len(cached.local), len(cached.global))
+	if configs.ReportCacheSize {
+		summary += fmt.Sprintf(", %s in total", formatSize(cachedSize(cached)))
+	}
+	log.Donef("%s", summary)
+
+	if configs.ExportToTestAddon {
+		fmt.Println()
+		log.Infof("Exporting timings to the test reports add-on...")
+		if resultDir := os.Getenv(testResultDirEnv); resultDir == "" {
+			log.Warnf("%s is not set, skipping the export", testResultDirEnv)
+		} else if reportPth, err := exportToTestAddon(resultDir, phases); err != nil {
+			log.Warnf("Failed to export timings: %s", err)
+		} else {
+			log.Printf("Timings written to %s", reportPth)
+		}
+	}
+
+	exportRestoreStatus(restoreStatusSuccess)
+	writeStepSummary(restoreStatusSuccess)
 }
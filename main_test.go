@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsExcludedCachePath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		pth      string
+		patterns []string
+		want     bool
+	}{
+		{name: "no patterns", pth: "/src/App/packages", patterns: nil, want: false},
+		{name: "absolute path", pth: "/src/App/packages", patterns: []string{"/src/App/packages"}, want: true},
+		{name: "absolute glob", pth: "/src/App/packages", patterns: []string{"/src/*/packages"}, want: true},
+		{name: "glob does not cross directories", pth: "/src/App/Sub/packages", patterns: []string{"/src/*/packages"}, want: false},
+		{name: "other path", pth: "/src/Lib/packages", patterns: []string{"/src/App/packages"}, want: false},
+		{name: "relative to the working directory", pth: filepath.Join(wd, "Samples", "packages"), patterns: []string{"Samples/*"}, want: true},
+		{name: "relative pattern of another directory", pth: filepath.Join(wd, "App", "packages"), patterns: []string{"Samples/*"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isExcludedCachePath(tt.pth, tt.patterns); got != tt.want {
+				t.Errorf("isExcludedCachePath(%s, %v) = %t, want %t", tt.pth, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCacheExcludePatterns(t *testing.T) {
+	got, err := parseCacheExcludePatterns("Samples/*, /src/Legacy/packages\n\n  Tools/packages  ")
+	if err != nil {
+		t.Fatalf("parseCacheExcludePatterns() error = %s", err)
+	}
+	if want := []string{"Samples/*", "/src/Legacy/packages", "Tools/packages"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCacheExcludePatterns() = %v, want %v", got, want)
+	}
+
+	if _, err := parseCacheExcludePatterns("Samples/[*"); err == nil {
+		t.Error("parseCacheExcludePatterns() succeeded for a malformed pattern, want an error")
+	}
+}
+
+func TestSelectCachedPaths(t *testing.T) {
+	candidates := cacheCandidates{
+		packagesDirs:      []string{"/src/App/packages", "/src/Lib/packages"},
+		globalPackagesDir: "/home/.nuget/packages",
+		restoreOutputDir:  "/src/restore-output",
+		nuGetBinariesDir:  "/home/.bitrise-nuget-cache",
+		restoreArtifacts:  []string{"/src/App/obj/project.assets.json"},
+	}
+
+	tests := []struct {
+		name       string
+		cacheLevel string
+		candidates cacheCandidates
+		want       cachedPaths
+	}{
+		{name: "none", cacheLevel: cacheInputNone, candidates: candidates, want: cachedPaths{}},
+		{name: "local without extras", cacheLevel: cacheInputlocal,
+			candidates: cacheCandidates{packagesDirs: candidates.packagesDirs, globalPackagesDir: candidates.globalPackagesDir},
+			want:       cachedPaths{local: []string{"/src/App/packages", "/src/Lib/packages"}},
+		},
+		{name: "local", cacheLevel: cacheInputlocal, candidates: candidates, want: cachedPaths{
+			local:  []string{"/src/App/packages", "/src/Lib/packages", "/src/restore-output", "/src/App/obj/project.assets.json"},
+			global: []string{"/home/.bitrise-nuget-cache"},
+		}},
+		{name: "global", cacheLevel: cacheInputGlobal, candidates: candidates, want: cachedPaths{
+			local:  []string{"/src/restore-output"},
+			global: []string{"/home/.nuget/packages", "/home/.bitrise-nuget-cache"},
+		}},
+		{name: "all", cacheLevel: cacheInputAll, candidates: candidates, want: cachedPaths{
+			local:  []string{"/src/App/packages", "/src/Lib/packages", "/src/restore-output", "/src/App/obj/project.assets.json"},
+			global: []string{"/home/.nuget/packages", "/home/.bitrise-nuget-cache"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectCachedPaths(tt.cacheLevel, tt.candidates); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectCachedPaths() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCacheLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "input", input: cacheInputGlobal, env: cacheInputNone, want: cacheInputGlobal},
+		{name: "inherit from the env", input: cacheInputInherit, env: cacheInputAll, want: cacheInputAll},
+		{name: "empty input inherits from the env", input: "", env: cacheInputNone, want: cacheInputNone},
+		{name: "default", input: cacheInputInherit, env: "", want: cacheInputlocal},
+		{name: "invalid input", input: "locale", wantErr: true},
+		{name: "invalid env", input: cacheInputInherit, env: "globl", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(cacheLevelEnv, tt.env)
+			got, err := resolveCacheLevel(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveCacheLevel() error = %v, want error: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveCacheLevel() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
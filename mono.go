@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-xamarin/constants"
+)
+
+const monoFrameworkNuGetPath = "/Library/Frameworks/Mono.framework/Versions/Current/bin/nuget"
+
+// monoPath is the mono executable running the downloaded and vendored .exe tools, resolved by resolveTool in main.
+var monoPath = constants.MonoPath
+
+// resolveTool returns the path of the given executable on the PATH (like /usr/bin/mono on Linux),
+// or the Mono.framework fallback path of the macOS stacks.
+// The fallback is returned even if it does not exist, the command using it reports the error.
+func resolveTool(name, fallbackPth string) string {
+	pth, err := lookPath(name, fallbackPth)
+	if err != nil {
+		log.Warnf("%s, using %s", err, fallbackPth)
+		return fallbackPth
+	}
+	log.Printf("Using %s: %s", name, pth)
+	return pth
+}
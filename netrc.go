@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	netrcEnvKey            = "NETRC"
+	netrcDefaultMachine    = ""
+	sourceCredentialEnvFmt = "NuGetPackageSourceCredentials_%s=Username=%s;Password=%s"
+)
+
+var (
+	nuGetSourcePattern     = regexp.MustCompile(`(?m)^\s*\d+\.\s+(.+?)\s+\[(?:Enabled|Disabled)\]\s*\n\s*(\S+)`)
+	envSafeSourceNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// netrcCredential is a login - password pair of a netrc machine entry.
+type netrcCredential struct {
+	login    string
+	password string
+}
+
+// netrc maps the machine names of a netrc file to their credentials.
+// The default entry is stored with an empty machine name.
+type netrc map[string]netrcCredential
+
+// credentials returns the credentials of the given host, falling back to the default entry.
+func (n netrc) credentials(host string) (netrcCredential, bool) {
+	if credential, ok := n[host]; ok {
+		return credential, true
+	}
+	credential, ok := n[netrcDefaultMachine]
+	return credential, ok
+}
+
+// parseNetrc parses the content of a netrc file.
+// Macro definitions and account tokens are skipped.
+func parseNetrc(content string) (netrc, error) {
+	entries := netrc{}
+
+	var lines []string
+	inMacro := false
+	for _, line := range strings.Split(content, "\n") {
+		if inMacro {
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "macdef" {
+			inMacro = true
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	tokens := strings.Fields(strings.Join(lines, "\n"))
+	machine, inEntry := "", false
+	for i := 0; i < len(tokens); i++ {
+		switch token := tokens[i]; token {
+		case "default":
+			machine, inEntry = netrcDefaultMachine, true
+			entries[machine] = netrcCredential{}
+		case "machine", "login", "password", "account":
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("missing value for token: %s", token)
+			}
+			i++
+			value := tokens[i]
+
+			if token == "machine" {
+				machine, inEntry = value, true
+				entries[machine] = netrcCredential{}
+				continue
+			}
+			if !inEntry {
+				return nil, fmt.Errorf("token (%s) found outside of a machine entry", token)
+			}
+
+			credential := entries[machine]
+			switch token {
+			case "login":
+				credential.login = value
+			case "password":
+				credential.password = value
+			}
+			entries[machine] = credential
+		default:
+			return nil, fmt.Errorf("unknown token: %s", token)
+		}
+	}
+
+	return entries, nil
+}
+
+// loadNetrc reads the netrc file pointed by the NETRC env var or the ~/.netrc file.
+// A missing netrc file results in empty credentials.
+func loadNetrc() (netrc, error) {
+	pth := os.Getenv(netrcEnvKey)
+	if pth == "" {
+		pth = filepath.Join(pathutil.UserHomeDir(), ".netrc")
+	}
+
+	if exist, err := pathutil.IsPathExists(pth); err != nil {
+		return nil, fmt.Errorf("failed to check if netrc exists at (%s): %s", pth, err)
+	} else if !exist {
+		log.Warnf("No netrc file found at (%s)", pth)
+		return netrc{}, nil
+	}
+
+	content, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read netrc (%s): %s", pth, err)
+	}
+
+	entries, err := parseNetrc(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse netrc (%s): %s", pth, err)
+	}
+
+	log.Printf("Loaded netrc (%s) with %d entries", pth, len(entries))
+	return entries, nil
+}
+
+// nuGetSource is a package source configured for NuGet.
+type nuGetSource struct {
+	name string
+	url  string
+}
+
+// parseNuGetSources parses the output of the `nuget sources list` command.
+func parseNuGetSources(output string) []nuGetSource {
+	var sources []nuGetSource
+	for _, match := range nuGetSourcePattern.FindAllStringSubmatch(output, -1) {
+		sources = append(sources, nuGetSource{name: match[1], url: match[2]})
+	}
+	return sources
+}
+
+// netrcSourceCredentialEnvs lists the configured package sources and returns
+// NuGetPackageSourceCredentials_<source name> envs for each source with matching netrc credentials.
+func netrcSourceCredentialEnvs(nuGetCmdArgs []string, credentials netrc) ([]string, error) {
+	cmdArgs := append(append([]string{}, nuGetCmdArgs...), "sources", "list", "-Format", "Detailed")
+	cmd, err := command.NewFromSlice(cmdArgs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NuGet command: %s", err)
+	}
+
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s, output: %s", command.PrintableCommandArgs(false, cmdArgs), err, out)
+	}
+
+	var envs []string
+	for _, source := range parseNuGetSources(out) {
+		u, err := url.Parse(source.url)
+		if err != nil || u.Host == "" {
+			continue
+		}
+
+		credential, ok := credentials.credentials(u.Hostname())
+		if !ok {
+			continue
+		}
+		if !envSafeSourceNameRegex.MatchString(source.name) {
+			log.Warnf("Package source name (%s) can not be used in an env var name, skipping its netrc credentials", source.name)
+			continue
+		}
+
+		log.Printf("Using netrc credentials for package source: %s (%s)", source.name, u.Hostname())
+		envs = append(envs, fmt.Sprintf(sourceCredentialEnvFmt, source.name, credential.login, credential.password))
+	}
+	return envs, nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/bitrise-io/go-utils/retry"
+)
+
+const nuGetVersionLatest = "latest"
+
+// minNoHTTPCacheMajorVersion is the first major NuGet version with the -NoHttpCache restore option.
+const minNoHTTPCacheMajorVersion = 4
+
+// defaultNuGetDownloadBaseURL is the public location of the nuget.exe binaries, as <base URL>/<version>/nuget.exe.
+const defaultNuGetDownloadBaseURL = "https://dist.nuget.org/win-x86-commandline"
+
+// nuGetCacheDirName is the directory in the user's home where the downloaded nuget.exe binaries are kept between builds.
+const nuGetCacheDirName = ".bitrise-nuget-cache"
+
+// nuGetCacheDir returns the directory where the downloaded nuget.exe binaries are kept between builds.
+func nuGetCacheDir() string {
+	return filepath.Join(pathutil.UserHomeDir(), nuGetCacheDirName)
+}
+
+// defaultDownloadTimeout limits a whole download attempt, a stalled connection would hang the build otherwise.
+const defaultDownloadTimeout = 300 * time.Second
+
+// defaultDownloadRetryWait is the wait before a download retry.
+const defaultDownloadRetryWait = time.Second
+
+// preflightTimeout limits the connectivity check, an unreachable host should fail fast.
+const preflightTimeout = 10 * time.Second
+
+var peMagic = []byte{'M', 'Z'}
+
+var sha256Pattern = regexp.MustCompile(`^\s*[0-9a-fA-F]{64}\s*$`)
+
+var nuGetVersionPattern = regexp.MustCompile(`NuGet Version: (\d+(?:\.\d+)+)`)
+
+// httpDoer sends HTTP requests, it is satisfied by *http.Client.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// DownloadFile ...
+func DownloadFile(downloadURL, targetPath string, credentials netrc) error {
+	return downloadFile(&http.Client{Timeout: defaultDownloadTimeout}, downloadURL, targetPath, credentials)
+}
+
+// maxDownloadResumes is the number of times an interrupted download is resumed with a Range request.
+const maxDownloadResumes = 3
+
+// downloadFile downloads the given URL to the target path with the given client.
+// If the transfer breaks and the server advertised Accept-Ranges: bytes, the download continues from the last written byte,
+// otherwise the error is returned and the next attempt starts over.
+func downloadFile(client httpDoer, downloadURL, targetPath string, credentials netrc) error {
+	outFile, err := os.Create(targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to create (%s): %s", targetPath, err)
+	}
+	defer func() {
+		if err := outFile.Close(); err != nil {
+			log.Warnf("Failed to close (%s)", targetPath)
+		}
+	}()
+
+	var written int64
+	for resumes := 0; ; resumes++ {
+		n, acceptsRanges, err := downloadRange(client, downloadURL, credentials, outFile, written)
+		if err == nil {
+			return nil
+		}
+		written = n
+		if !acceptsRanges || written == 0 || resumes >= maxDownloadResumes {
+			return err
+		}
+		log.Warnf("Download interrupted after %d bytes, resuming: %s", written, err)
+	}
+}
+
+// downloadRange downloads the given URL into the file, starting at the given offset.
+// It returns the size of the file after the transfer and whether the server supports byte range requests.
+// If the server ignores the Range header and sends the whole content, the file is rewritten from the start.
+func downloadRange(client httpDoer, downloadURL string, credentials netrc, outFile *os.File, offset int64) (int64, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return offset, false, fmt.Errorf("failed to create request for (%s): %s", downloadURL, err)
+	}
+	if credential, ok := credentials.credentials(req.URL.Hostname()); ok {
+		req.SetBasicAuth(credential.login, credential.password)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// the server supported ranges before, if it did not we would not try to resume
+		return offset, offset > 0, fmt.Errorf("failed to download from (%s): %w", downloadURL, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("failed to close (%s) body", downloadURL)
+		}
+	}()
+
+	acceptsRanges := strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes")
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		acceptsRanges = true
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			log.Warnf("Server ignored the Range request, downloading the whole file again")
+			if err := outFile.Truncate(0); err != nil {
+				return offset, false, fmt.Errorf("failed to truncate (%s): %s", outFile.Name(), err)
+			}
+			if _, err := outFile.Seek(0, io.SeekStart); err != nil {
+				return offset, false, fmt.Errorf("failed to seek (%s): %s", outFile.Name(), err)
+			}
+			offset = 0
+		}
+	default:
+		return offset, false, fmt.Errorf("request failed, status code: %d", resp.StatusCode)
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	written, err := io.Copy(outFile, newProgressReader(resp.Body, offset, total))
+	if err != nil {
+		return offset + written, acceptsRanges, fmt.Errorf("failed to copy to (%s): %w", outFile.Name(), err)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return offset + written, acceptsRanges, fmt.Errorf("download truncated, expected %d bytes, got %d", resp.ContentLength, written)
+	}
+	return offset + written, acceptsRanges, nil
+}
+
+// NuGetOptions ...
+type NuGetOptions struct {
+	// CacheDir is the directory where the downloaded binaries are kept between builds, see nuGetCachePath.
+	// Floating versions (like latest) are never reused from the cache. Caching is disabled when empty.
+	CacheDir string
+	// Checksum is the expected SHA-256 checksum of the binary, the checksum is not verified when empty.
+	Checksum string
+	// Credentials are applied to the download as basic auth if they contain the download host.
+	Credentials netrc
+	// Timeout limits a download attempt, defaults to defaultDownloadTimeout. Only used if Client is not set.
+	Timeout time.Duration
+	// Proxy is the proxy of the downloads, the proxy of the environment (HTTPS_PROXY) is used if nil. Only used if Client is not set.
+	Proxy *url.URL
+	// Client sends the download requests, defaults to a client with the Timeout and Proxy.
+	Client httpDoer
+	// RetryJitterPercent randomizes the wait before a download retry by up to this percent.
+	RetryJitterPercent int
+	// PreflightCheck makes the download fail fast if the download host is unreachable, see checkConnectivity.
+	PreflightCheck bool
+	// DownloadBaseURL replaces defaultNuGetDownloadBaseURL, for mirrors keeping the <version>/nuget.exe layout.
+	DownloadBaseURL string
+	// RetryCount is the number of retries after a failed download attempt.
+	RetryCount uint
+	// RetryWait is the wait before a download retry, defaults to defaultDownloadRetryWait.
+	RetryWait time.Duration
+	// DownloadDir is the directory the nuget.exe is downloaded into, defaults to a directory in the OS temp dir.
+	DownloadDir string
+	// Download fetches the given URL to the target path, defaults to downloading with the Client.
+	Download func(downloadURL, targetPath string) error
+}
+
+// newHTTPClient returns a client with the given timeout, sending the requests through the given proxy.
+// The proxy of the environment is used if the given proxy is nil.
+func newHTTPClient(timeout time.Duration, proxy *url.URL) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// EnsureNuGet returns the path of a ready to use nuget.exe with the given version.
+// A valid binary is reused from the cache dir, otherwise it is downloaded (and stored into the cache dir).
+func EnsureNuGet(version string, opts NuGetOptions) (string, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultDownloadTimeout
+	}
+	if opts.RetryWait == 0 {
+		opts.RetryWait = defaultDownloadRetryWait
+	}
+	if opts.Client == nil {
+		opts.Client = newHTTPClient(opts.Timeout, opts.Proxy)
+	}
+	if opts.Download == nil {
+		opts.Download = func(downloadURL, targetPath string) error {
+			err := downloadFile(opts.Client, downloadURL, targetPath, opts.Credentials)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return fmt.Errorf("nuget.exe download timed out after %ds", int(opts.Timeout.Seconds()))
+			}
+			return err
+		}
+	}
+
+	cachedPth := ""
+	if opts.CacheDir != "" && !isFloatingNuGetVersion(version) {
+		cachedPth = nuGetCachePath(opts.CacheDir, version, opts.DownloadBaseURL)
+		if exist, err := pathutil.IsPathExists(cachedPth); err != nil {
+			log.Warnf("Failed to check if cached NuGet exists: %s", err)
+		} else if exist {
+			if err := verifyNuGet(cachedPth, opts.Checksum); err != nil {
+				log.Warnf("Cached NuGet is invalid, downloading it again: %s", err)
+			} else {
+				log.Printf("Using cached NuGet: %s", cachedPth)
+				return cachedPth, nil
+			}
+		}
+	}
+
+	downloadPth, err := downloadNuGet(version, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if cachedPth != "" {
+		if err := copyFile(downloadPth, cachedPth, 0755); err != nil {
+			log.Warnf("Failed to cache NuGet: %s", err)
+		} else {
+			log.Printf("Cached NuGet: %s", cachedPth)
+			return cachedPth, nil
+		}
+	}
+	return downloadPth, nil
+}
+
+// nuGetCachePath returns the path of the given NuGet version in the cache dir: <cache dir>/<version>/nuget.exe
+// for the default download location, <cache dir>/<version>/<base URL hash>/nuget.exe for a mirror,
+// so a binary downloaded from one location is never reused for another.
+func nuGetCachePath(cacheDir, version, baseURL string) string {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if baseURL == "" || baseURL == defaultNuGetDownloadBaseURL {
+		return filepath.Join(cacheDir, version, "nuget.exe")
+	}
+	hash := sha256.Sum256([]byte(baseURL))
+	return filepath.Join(cacheDir, version, hex.EncodeToString(hash[:])[:16], "nuget.exe")
+}
+
+// prepareVendoredNuGet validates a nuget.exe committed into the repository and makes it executable.
+func prepareVendoredNuGet(pth, checksum string) (string, error) {
+	absPth, err := filepath.Abs(pth)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine vendored NuGet path: %s", err)
+	}
+	if info, err := os.Stat(absPth); err != nil {
+		return "", fmt.Errorf("vendored NuGet (%s) does not exist: %s", absPth, err)
+	} else if info.IsDir() {
+		return "", fmt.Errorf("vendored NuGet (%s) is a directory", absPth)
+	}
+	if err := verifyNuGet(absPth, checksum); err != nil {
+		return "", fmt.Errorf("invalid vendored NuGet: %s", err)
+	}
+	if err := os.Chmod(absPth, 0755); err != nil {
+		return "", fmt.Errorf("failed to make (%s) executable: %s", absPth, err)
+	}
+	return absPth, nil
+}
+
+// prepareDownloadDir creates the given download directory if needed and checks whether it is writable.
+// It returns the absolute path of the directory.
+func prepareDownloadDir(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine download dir path: %s", err)
+	}
+	if err := os.MkdirAll(absDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create download dir (%s): %s", absDir, err)
+	}
+
+	probe, err := ioutil.TempFile(absDir, ".write-test")
+	if err != nil {
+		return "", fmt.Errorf("download dir (%s) is not writable: %s", absDir, err)
+	}
+	if err := probe.Close(); err != nil {
+		log.Warnf("Failed to close (%s)", probe.Name())
+	}
+	if err := os.Remove(probe.Name()); err != nil {
+		log.Warnf("Failed to remove (%s)", probe.Name())
+	}
+	return absDir, nil
+}
+
+// validateSystemNuGet checks whether the given NuGet binary exists and is executable, returning its absolute path.
+func validateSystemNuGet(pth string) (string, error) {
+	absPth, err := filepath.Abs(pth)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine NuGet path: %s", err)
+	}
+	info, err := os.Stat(absPth)
+	if err != nil {
+		return "", fmt.Errorf("NuGet (%s) does not exist: %s", absPth, err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("NuGet (%s) is a directory", absPth)
+	}
+	if info.Mode()&0111 == 0 {
+		return "", fmt.Errorf("NuGet (%s) is not executable", absPth)
+	}
+	return absPth, nil
+}
+
+// downloadNuGet downloads NuGet with the given version.
+func downloadNuGet(version string, opts NuGetOptions) (string, error) {
+	fmt.Println()
+	log.Infof("Downloading NuGet %s version...", version)
+	downloadDir := opts.DownloadDir
+	if downloadDir == "" {
+		tmpDir, err := pathutil.NormalizedOSTempDirPath("__nuget__")
+		if err != nil {
+			return "", fmt.Errorf("failed to create tmp dir: %s", err)
+		}
+		downloadDir = tmpDir
+	}
+
+	downloadPth := filepath.Join(downloadDir, "nuget.exe")
+	log.Printf("Download path: %s", downloadPth)
+
+	nuGetURL := nuGetDownloadURL(opts.DownloadBaseURL, version)
+
+	log.Printf("Download URL: %s", nuGetURL)
+	if opts.PreflightCheck {
+		if err := checkConnectivity(opts.Client, nuGetURL); err != nil {
+			return "", err
+		}
+	}
+	if u, err := url.Parse(nuGetURL); err == nil {
+		if _, ok := opts.Credentials.credentials(u.Hostname()); ok {
+			log.Printf("Using netrc credentials for host: %s", u.Hostname())
+		}
+	}
+	if err := retry.Times(opts.RetryCount).Try(func(attempt uint) error {
+		if attempt > 0 {
+			time.Sleep(jitteredWait(opts.RetryWait, opts.RetryJitterPercent))
+			log.Warnf("Retrying (%d/%d)...", attempt, opts.RetryCount)
+		}
+		if err := opts.Download(nuGetURL, downloadPth); err != nil {
+			if attempt < opts.RetryCount {
+				log.Warnf("Failed to download NuGet: %s", err)
+			}
+			return err
+		}
+		if err := verifyNuGet(downloadPth, opts.Checksum); err != nil {
+			if attempt < opts.RetryCount {
+				log.Warnf("Failed to validate NuGet: %s", err)
+			}
+			return err
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	if err := os.Chmod(downloadPth, 0755); err != nil {
+		return "", fmt.Errorf("failed to make (%s) executable: %s", downloadPth, err)
+	}
+	return downloadPth, nil
+}
+
+// checkConnectivity sends a HEAD request to the given URL with the given client.
+// Any HTTP response counts as reachable, only transport errors (DNS, TLS, proxy or connection failures) are reported.
+func checkConnectivity(client httpDoer, rawURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodHead, rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for (%s): %s", rawURL, err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("connectivity check failed, %s is unreachable: %s", req.URL.Host, err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Warnf("failed to close (%s) body", rawURL)
+	}
+	log.Printf("Connectivity check passed: %s", req.URL.Host)
+	return nil
+}
+
+// nuGetDownloadURL returns the download URL of the given NuGet version under the given base URL
+// (defaultNuGetDownloadBaseURL if empty), like:
+// https://dist.nuget.org/win-x86-commandline/latest/nuget.exe or
+// https://dist.nuget.org/win-x86-commandline/v3.3.0/nuget.exe
+func nuGetDownloadURL(baseURL, version string) string {
+	if baseURL == "" {
+		baseURL = defaultNuGetDownloadBaseURL
+	}
+	if version != nuGetVersionLatest {
+		version = `v` + version
+	}
+	return fmt.Sprintf("%s/%s/nuget.exe", strings.TrimSuffix(baseURL, "/"), version)
+}
+
+// verifyNuGet checks whether the given file is a PE executable with the expected checksum.
+// The checksum is not verified if the expected checksum is empty.
+func verifyNuGet(pth, checksum string) error {
+	if err := validateExecutable(pth); err != nil {
+		return err
+	}
+	if checksum == "" {
+		return nil
+	}
+
+	actual, err := fileSHA256(pth)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, strings.TrimSpace(checksum)) {
+		return fmt.Errorf("checksum mismatch, expected: %s, got: %s", checksum, actual)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 checksum of the given file.
+func fileSHA256(pth string) (string, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return "", fmt.Errorf("failed to open (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close (%s)", pth)
+		}
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read (%s): %s", pth, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile copies the source file to the target path with the permissions of the given mode, creating the target's directory if needed.
+// The file is written next to the target first and renamed into place, so the target is never left half written.
+func copyFile(sourcePth, targetPth string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(targetPth), 0755); err != nil {
+		return fmt.Errorf("failed to create (%s): %s", filepath.Dir(targetPth), err)
+	}
+
+	in, err := os.Open(sourcePth)
+	if err != nil {
+		return fmt.Errorf("failed to open (%s): %s", sourcePth, err)
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Warnf("Failed to close (%s)", sourcePth)
+		}
+	}()
+
+	tmpPth := targetPth + ".tmp"
+	out, err := os.OpenFile(tmpPth, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create (%s): %s", tmpPth, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("failed to copy to (%s): %s", tmpPth, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close (%s): %s", tmpPth, err)
+	}
+
+	return os.Rename(tmpPth, targetPth)
+}
+
+// validateExecutable checks whether the given file starts with the MZ header of a PE executable.
+// A proxy or captive portal may respond with an HTML error page and a 200 status code.
+func validateExecutable(pth string) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return fmt.Errorf("failed to open (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close (%s)", pth)
+		}
+	}()
+
+	header := make([]byte, len(peMagic))
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header, peMagic) {
+		return fmt.Errorf("downloaded file is not a valid executable (%s)", pth)
+	}
+	return nil
+}
+
+// isFloatingNuGetVersion reports whether the given version input does not pin a concrete NuGet version.
+func isFloatingNuGetVersion(version string) bool {
+	return version == nuGetVersionLatest
+}
+
+// nuGetMajorVersion returns the major version of the given concrete NuGet version, like 4 of 4.9.6.
+// The second return value is false for floating or unparsable versions.
+func nuGetMajorVersion(version string) (int, bool) {
+	major, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0])
+	if err != nil {
+		return 0, false
+	}
+	return major, true
+}
+
+// parseNuGetVersion parses the concrete version from the output of the nuget help command.
+func parseNuGetVersion(output string) (string, error) {
+	match := nuGetVersionPattern.FindStringSubmatch(output)
+	if len(match) < 2 {
+		return "", fmt.Errorf("no version found in output: %s", output)
+	}
+	return match[1], nil
+}
+
+// resolveNuGetVersion returns the concrete version of the NuGet invoked by the given command args.
+func resolveNuGetVersion(nuGetCmdArgs []string) (string, error) {
+	cmdArgs := append(append([]string{}, nuGetCmdArgs...), "help")
+	cmd, err := command.NewFromSlice(cmdArgs)
+	if err != nil {
+		return "", fmt.Errorf("failed to create NuGet command: %s", err)
+	}
+
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %s, output: %s", command.PrintableCommandArgs(false, cmdArgs), err, out)
+	}
+	return parseNuGetVersion(out)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNuGet is the content of a minimal PE executable, as accepted by validateExecutable.
+var fakeNuGet = []byte("MZ fake nuget.exe")
+
+func TestEnsureNuGetCache(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      string
+		cached       []byte
+		wantDownload bool
+	}{
+		{name: "cache hit", version: "5.11.0", cached: fakeNuGet, wantDownload: false},
+		{name: "cache miss", version: "5.11.0", cached: nil, wantDownload: true},
+		{name: "corrupted cache", version: "5.11.0", cached: []byte("<html>Proxy error</html>"), wantDownload: true},
+		{name: "floating version is never cached", version: nuGetVersionLatest, cached: fakeNuGet, wantDownload: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir, downloadDir := t.TempDir(), t.TempDir()
+			cachedPth := filepath.Join(cacheDir, tt.version, "nuget.exe")
+			if tt.cached != nil {
+				if err := os.MkdirAll(filepath.Dir(cachedPth), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(cachedPth, tt.cached, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			downloaded := false
+			pth, err := EnsureNuGet(tt.version, NuGetOptions{
+				CacheDir:    cacheDir,
+				DownloadDir: downloadDir,
+				Download: func(downloadURL, targetPath string) error {
+					downloaded = true
+					return ioutil.WriteFile(targetPath, fakeNuGet, 0644)
+				},
+			})
+			if err != nil {
+				t.Fatalf("EnsureNuGet() error = %s", err)
+			}
+			if downloaded != tt.wantDownload {
+				t.Errorf("downloaded = %t, want %t", downloaded, tt.wantDownload)
+			}
+
+			wantPth := cachedPth
+			if isFloatingNuGetVersion(tt.version) {
+				wantPth = filepath.Join(downloadDir, "nuget.exe")
+			}
+			if pth != wantPth {
+				t.Errorf("EnsureNuGet() = %s, want %s", pth, wantPth)
+			}
+			content, err := ioutil.ReadFile(pth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != string(fakeNuGet) {
+				t.Errorf("NuGet content = %q, want %q", content, fakeNuGet)
+			}
+		})
+	}
+}
+
+func TestEnsureNuGetRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		retryCount   uint
+		wantAttempts int
+		wantErr      string
+	}{
+		{name: "succeeds at first", failures: 0, retryCount: 2, wantAttempts: 1},
+		{name: "succeeds on a retry", failures: 2, retryCount: 2, wantAttempts: 3},
+		{name: "no retry", failures: 1, retryCount: 0, wantAttempts: 1, wantErr: "download failed (attempt 1)"},
+		{name: "always failing", failures: 5, retryCount: 2, wantAttempts: 3, wantErr: "download failed (attempt 3)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			pth, err := EnsureNuGet("5.11.0", NuGetOptions{
+				DownloadDir: t.TempDir(),
+				RetryCount:  tt.retryCount,
+				RetryWait:   time.Millisecond,
+				Download: func(downloadURL, targetPath string) error {
+					attempts++
+					if attempts <= tt.failures {
+						return fmt.Errorf("download failed (attempt %d)", attempts)
+					}
+					return ioutil.WriteFile(targetPath, fakeNuGet, 0644)
+				},
+			})
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("EnsureNuGet() error = %s", err)
+				}
+				if content, err := ioutil.ReadFile(pth); err != nil || string(content) != string(fakeNuGet) {
+					t.Errorf("EnsureNuGet() = %s, content: %q, error: %v", pth, content, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("EnsureNuGet() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnsureNuGetCacheMirrorChange(t *testing.T) {
+	cacheDir := t.TempDir()
+	download := func(content string, downloads *[]string) func(string, string) error {
+		return func(downloadURL, targetPath string) error {
+			*downloads = append(*downloads, downloadURL)
+			return ioutil.WriteFile(targetPath, []byte("MZ "+content), 0644)
+		}
+	}
+
+	var downloads []string
+	for _, baseURL := range []string{"https://mirror-a.example.com/nuget", "https://mirror-b.example.com/nuget", "https://mirror-a.example.com/nuget/"} {
+		pth, err := EnsureNuGet("5.11.0", NuGetOptions{
+			CacheDir:        cacheDir,
+			DownloadDir:     t.TempDir(),
+			DownloadBaseURL: baseURL,
+			Download:        download(baseURL, &downloads),
+		})
+		if err != nil {
+			t.Fatalf("EnsureNuGet() error = %s", err)
+		}
+		if want := nuGetCachePath(cacheDir, "5.11.0", baseURL); pth != want {
+			t.Errorf("EnsureNuGet() = %s, want %s", pth, want)
+		}
+	}
+
+	// The second mirror does not reuse the binary of the first one, the first mirror reuses its own binary.
+	want := []string{
+		"https://mirror-a.example.com/nuget/v5.11.0/nuget.exe",
+		"https://mirror-b.example.com/nuget/v5.11.0/nuget.exe",
+	}
+	if strings.Join(downloads, ",") != strings.Join(want, ",") {
+		t.Errorf("downloads = %v, want %v", downloads, want)
+	}
+	if nuGetCachePath(cacheDir, "5.11.0", "") != nuGetCachePath(cacheDir, "5.11.0", defaultNuGetDownloadBaseURL+"/") {
+		t.Error("nuGetCachePath() differs for the default download location")
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	content := strings.Repeat("nuget", 100)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{
+			name: "success",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = fmt.Fprint(w, content)
+			},
+		},
+		{
+			name: "non-200 status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			wantErr: "status code: 404",
+		},
+		{
+			name: "truncated body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+				_, _ = fmt.Fprint(w, content[:10])
+			},
+			wantErr: "failed to copy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			targetPth := filepath.Join(t.TempDir(), "nuget.exe")
+			err := downloadFile(server.Client(), server.URL, targetPth, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("downloadFile() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadFile() error = %s", err)
+			}
+			if got, err := ioutil.ReadFile(targetPth); err != nil {
+				t.Fatal(err)
+			} else if string(got) != content {
+				t.Errorf("downloaded content = %q, want %q", got, content)
+			}
+		})
+	}
+}
+
+func TestDownloadFileTimeout(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := server.Client()
+	client.Timeout = 50 * time.Millisecond
+	err := downloadFile(client, server.URL, filepath.Join(t.TempDir(), "nuget.exe"), nil)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("downloadFile() error = %v, want a timeout", err)
+	}
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	content := strings.Repeat("nuget", 100)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		var offset int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		}
+
+		// Every response breaks after 100 bytes, so the download needs several resumes.
+		rest := content[offset:]
+		if len(rest) > 100 {
+			rest = rest[:100]
+		}
+		_, _ = fmt.Fprint(w, rest)
+	}))
+	defer server.Close()
+
+	targetPth := filepath.Join(t.TempDir(), "nuget.exe")
+	err := downloadFile(server.Client(), server.URL, targetPth, nil)
+	if err == nil {
+		t.Fatalf("downloadFile() succeeded, want an error after %d resumes", maxDownloadResumes)
+	}
+	if len(ranges) != maxDownloadResumes+1 {
+		t.Fatalf("requests = %d, want %d", len(ranges), maxDownloadResumes+1)
+	}
+	for i, got := range ranges[1:] {
+		if want := fmt.Sprintf("bytes=%d-", (i+1)*100); got != want {
+			t.Errorf("Range of resume %d = %q, want %q", i+1, got, want)
+		}
+	}
+
+	// A download which completes within the resume limit succeeds.
+	content = strings.Repeat("nuget", 60)
+	ranges = nil
+	if err := downloadFile(server.Client(), server.URL, targetPth, nil); err != nil {
+		t.Fatalf("downloadFile() error = %s", err)
+	}
+	if got, err := ioutil.ReadFile(targetPth); err != nil {
+		t.Fatal(err)
+	} else if string(got) != content {
+		t.Errorf("downloaded content = %q, want %q", got, content)
+	}
+}
+
+func TestVerifyNuGetRejectsHTMLPage(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "nuget.exe")
+	page := "<!DOCTYPE html><html><body>407 Proxy Authentication Required</body></html>"
+	if err := ioutil.WriteFile(pth, []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := verifyNuGet(pth, "")
+	if err == nil {
+		t.Fatal("verifyNuGet() succeeded for an HTML page, want an error")
+	}
+	if !strings.Contains(err.Error(), "not a valid executable") {
+		t.Errorf("verifyNuGet() error = %s, want a not a valid executable error", err)
+	}
+}
+
+func TestVerifyNuGetChecksum(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "nuget.exe")
+	if err := ioutil.WriteFile(pth, fakeNuGet, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := fileSHA256(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantErr  bool
+	}{
+		{name: "no checksum", checksum: ""},
+		{name: "match", checksum: checksum},
+		{name: "match with upper case and whitespace", checksum: " " + strings.ToUpper(checksum) + "\n"},
+		{name: "mismatch", checksum: strings.Repeat("0", 64), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyNuGet(pth, tt.checksum)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+					t.Fatalf("verifyNuGet() error = %v, want a checksum mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyNuGet() error = %s", err)
+			}
+		})
+	}
+}
+
+func TestNuGetDownloadURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		version string
+		want    string
+	}{
+		{name: "default base URL", baseURL: "", version: "5.11.0", want: "https://dist.nuget.org/win-x86-commandline/v5.11.0/nuget.exe"},
+		{name: "default base URL latest", baseURL: "", version: nuGetVersionLatest, want: "https://dist.nuget.org/win-x86-commandline/latest/nuget.exe"},
+		{name: "custom base URL with trailing slash", baseURL: "https://mirror.example.com/nuget/", version: "4.9.4", want: "https://mirror.example.com/nuget/v4.9.4/nuget.exe"},
+		{name: "custom base URL latest", baseURL: "https://mirror.example.com/nuget", version: nuGetVersionLatest, want: "https://mirror.example.com/nuget/latest/nuget.exe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nuGetDownloadURL(tt.baseURL, tt.version); got != tt.want {
+				t.Errorf("nuGetDownloadURL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	privateFeedSourceNamePrefix = "BitrisePrivateFeed"
+	publicNuGetSourceName       = "nuget.org"
+)
+
+// nuGetConfigEntry is an add element of a NuGet.Config section.
+type nuGetConfigEntry struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// nuGetConfigSourceCredentials is the credentials element of a package source, named after the source.
+type nuGetConfigSourceCredentials struct {
+	XMLName xml.Name
+	Entries []nuGetConfigEntry `xml:"add"`
+}
+
+// nuGetConfig is the content of a NuGet.Config file with package sources and their credentials.
+type nuGetConfig struct {
+	XMLName           xml.Name                       `xml:"configuration"`
+	PackageSources    []nuGetConfigEntry             `xml:"packageSources>add"`
+	SourceCredentials []nuGetConfigSourceCredentials `xml:"packageSourceCredentials>source"`
+}
+
+// parsePrivateFeeds parses the private_feeds input, one `<feed URL> <username> <password>` feed per line.
+// The feeds are named BitrisePrivateFeed1, BitrisePrivateFeed2, ... in the order of the lines.
+func parsePrivateFeeds(list string) ([]feedSource, error) {
+	var feeds []feedSource
+	for i, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			// The line is not printed, as it contains the secrets.
+			return nil, fmt.Errorf("invalid private feed in line %d, expected: <feed URL> <username> <password>", i+1)
+		}
+		if err := validateSourceURL(fields[0]); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, feedSource{
+			name:       fmt.Sprintf("%s%d", privateFeedSourceNamePrefix, len(feeds)+1),
+			url:        fields[0],
+			credential: feedCredential{Username: fields[1], Password: fields[2]},
+		})
+	}
+	return feeds, nil
+}
+
+// newNuGetConfig returns the NuGet.Config content of the public nuget.org feed and the given feeds with their credentials.
+// The passwords are stored in clear text, as Mono can not encrypt them.
+func newNuGetConfig(feeds []feedSource) ([]byte, error) {
+	config := nuGetConfig{PackageSources: []nuGetConfigEntry{{Key: publicNuGetSourceName, Value: publicNuGetSource}}}
+	for _, feed := range feeds {
+		config.PackageSources = append(config.PackageSources, nuGetConfigEntry{Key: feed.name, Value: feed.url})
+		config.SourceCredentials = append(config.SourceCredentials, nuGetConfigSourceCredentials{
+			XMLName: xml.Name{Local: feed.name},
+			Entries: []nuGetConfigEntry{
+				{Key: "Username", Value: feed.credential.Username},
+				{Key: "ClearTextPassword", Value: feed.credential.Password},
+			},
+		})
+	}
+
+	content, err := xml.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), content...), nil
+}
+
+// writeNuGetConfig writes the NuGet.Config of the given feeds into a new temporary directory and returns its path.
+// The directory is removed when the step exits, on every exit path, so the credentials do not outlive the step.
+func writeNuGetConfig(feeds []feedSource) (string, error) {
+	content, err := newNuGetConfig(feeds)
+	if err != nil {
+		return "", fmt.Errorf("failed to create NuGet.Config: %s", err)
+	}
+
+	tmpDir, err := pathutil.NormalizedOSTempDirPath("__nuget_config__")
+	if err != nil {
+		return "", fmt.Errorf("failed to create tmp dir: %s", err)
+	}
+	addCleanup(func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Warnf("Failed to remove the generated NuGet.Config: %s", err)
+		} else {
+			log.Printf("Removed the generated NuGet.Config")
+		}
+	})
+	pth := filepath.Join(tmpDir, "NuGet.Config")
+	if err := ioutil.WriteFile(pth, content, 0600); err != nil {
+		return "", fmt.Errorf("failed to write NuGet.Config (%s): %s", pth, err)
+	}
+	return pth, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteNuGetConfigRemovedOnFailure(t *testing.T) {
+	defer func() { cleanups = nil }()
+	feeds := []feedSource{
+		{name: "BitrisePrivateFeed1", url: "https://feed.example.com/index.json", credential: feedCredential{Username: "user", Password: "secret"}},
+	}
+
+	var pth string
+	code := catchExit(t, func() {
+		var err error
+		if pth, err = writeNuGetConfig(feeds); err != nil {
+			fail("Failed to generate NuGet.Config: %s", err)
+		}
+		if _, err := os.Stat(pth); err != nil {
+			t.Errorf("generated NuGet.Config does not exist: %s", err)
+		}
+		fail("restore failed")
+	})
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+
+	if _, err := os.Stat(filepath.Dir(pth)); !os.IsNotExist(err) {
+		t.Errorf("the generated NuGet.Config dir (%s) is not removed after the step failed: %v", filepath.Dir(pth), err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// packagesDirsConcurrency is the maximum number of directories searched for packages folders at the same time.
+const packagesDirsConcurrency = 8
+
+// findPackagesDirs returns the packages folders under the given root, except the ones matching an exclude pattern, sorted.
+// The directories are searched concurrently by walkDirs, so the result is sorted to stay stable between runs.
+// The content of a packages folder is cached with it, nested packages folders are not collected separately.
+func findPackagesDirs(root string, excludes []string) ([]string, error) {
+	if filepath.Base(root) == "packages" {
+		if isExcludedCachePath(root, excludes) {
+			log.Debugf("Excluded from the cache: %s", root)
+			return nil, nil
+		}
+		return []string{root}, nil
+	}
+
+	var (
+		mu    sync.Mutex
+		found = map[string]bool{}
+	)
+	if err := walkDirs(root, packagesDirsConcurrency, func(dir string, entries []os.FileInfo) []string {
+		var subdirs []string
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			pth := filepath.Join(dir, entry.Name())
+			if entry.Name() != "packages" {
+				subdirs = append(subdirs, pth)
+				continue
+			}
+			if isExcludedCachePath(pth, excludes) {
+				log.Debugf("Excluded from the cache: %s", pth)
+				continue
+			}
+			mu.Lock()
+			found[pth] = true
+			mu.Unlock()
+		}
+		return subdirs
+	}); err != nil {
+		return nil, err
+	}
+
+	var packagesDirs []string
+	for pth := range found {
+		packagesDirs = append(packagesDirs, pth)
+	}
+	sort.Strings(packagesDirs)
+	return packagesDirs, nil
+}
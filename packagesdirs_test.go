@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// mkdirs creates the given directories under root and returns their paths.
+func mkdirs(t testing.TB, root string, dirs ...string) []string {
+	var pths []string
+	for _, dir := range dirs {
+		pth := filepath.Join(root, filepath.FromSlash(dir))
+		if err := os.MkdirAll(pth, 0755); err != nil {
+			t.Fatal(err)
+		}
+		pths = append(pths, pth)
+	}
+	return pths
+}
+
+func TestFindPackagesDirsDeepTree(t *testing.T) {
+	root := t.TempDir()
+	var want []string
+	for i := 0; i < 20; i++ {
+		project := fmt.Sprintf("src/group%d/sub/deeper/Project%d", i%4, i)
+		want = append(want, mkdirs(t, root, project+"/packages")...)
+		// The packages folders nested into a collected one are cached with it.
+		mkdirs(t, root, project+"/packages/Some.Package/packages")
+	}
+
+	sort.Strings(want)
+
+	for run := 0; run < 5; run++ {
+		got, err := findPackagesDirs(root, nil)
+		if err != nil {
+			t.Fatalf("findPackagesDirs() error = %s", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("findPackagesDirs() = %v, want %v", got, want)
+		}
+	}
+}
+
+func BenchmarkFindPackagesDirs(b *testing.B) {
+	root := b.TempDir()
+	createTree(b, root, 4, 6, 2, 16)
+	for i := 0; i < 50; i++ {
+		mkdirs(b, root, fmt.Sprintf("dir%d/dir%d/packages", i%6, i%5))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := findPackagesDirs(root, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCollectLocalCachesSiblingProjects(t *testing.T) {
+	root := t.TempDir()
+	want := mkdirs(t, root, "ProjectA/packages", "ProjectB/packages")
+	mkdirs(t, root, "ProjectA/packages/Some.Package/lib", "ProjectB/src")
+
+	got, err := collectLocalCaches(root, "", nil)
+	if err != nil {
+		t.Fatalf("collectLocalCaches() error = %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collectLocalCaches() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// slowestPackageCount is the number of packages listed by logPackageTimings.
+const slowestPackageCount = 10
+
+var (
+	packageRequestPattern = regexp.MustCompile(`(?m)^\s*(?:OK|CACHE|NotFound)\s+(\S+)\s+(\d+)ms\s*$`)
+	v2PackageIDPattern    = regexp.MustCompile(`(?i)id='([^']+)'`)
+)
+
+// packageTiming is the total time spent on the HTTP requests of a package.
+type packageTiming struct {
+	id       string
+	duration time.Duration
+	requests int
+}
+
+// packageIDFromURL returns the id of the package a feed request URL belongs to.
+// Both the v3 flat container / registration and the v2 OData URL layouts are recognized,
+// the URL itself is returned if the id can not be determined.
+func packageIDFromURL(requestURL string) string {
+	if match := v2PackageIDPattern.FindStringSubmatch(requestURL); len(match) == 2 {
+		return strings.ToLower(match[1])
+	}
+
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return requestURL
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	last := segments[len(segments)-1]
+	switch {
+	case strings.HasSuffix(last, ".nupkg") && len(segments) >= 3:
+		// <base>/<id>/<version>/<id>.<version>.nupkg
+		return strings.ToLower(segments[len(segments)-3])
+	case last == "index.json" && len(segments) >= 2:
+		// <base>/<id>/index.json
+		return strings.ToLower(segments[len(segments)-2])
+	}
+	return requestURL
+}
+
+// parsePackageTimings sums the durations of the feed requests found in the restore output per package,
+// ordered by duration, slowest first.
+func parsePackageTimings(output string) []packageTiming {
+	timingByID := map[string]*packageTiming{}
+	for _, match := range packageRequestPattern.FindAllStringSubmatch(output, -1) {
+		ms, err := strconv.Atoi(match[2])
+		if err != nil {
+			continue
+		}
+
+		id := packageIDFromURL(match[1])
+		timing, ok := timingByID[id]
+		if !ok {
+			timing = &packageTiming{id: id}
+			timingByID[id] = timing
+		}
+		timing.duration += time.Duration(ms) * time.Millisecond
+		timing.requests++
+	}
+
+	var timings []packageTiming
+	for _, timing := range timingByID {
+		timings = append(timings, *timing)
+	}
+	sort.Slice(timings, func(i, j int) bool {
+		if timings[i].duration != timings[j].duration {
+			return timings[i].duration > timings[j].duration
+		}
+		return timings[i].id < timings[j].id
+	})
+	return timings
+}
+
+// logPackageTimings logs the slowest packages of the restore.
+// The per request timings are printed by nuget with detailed verbosity.
+func logPackageTimings(output string) {
+	timings := parsePackageTimings(output)
+	if len(timings) == 0 {
+		log.Printf("No per package timing found in the restore output, try running the restore with detailed verbosity")
+		return
+	}
+
+	if len(timings) > slowestPackageCount {
+		timings = timings[:slowestPackageCount]
+	}
+
+	log.Printf("Slowest packages:")
+	for _, timing := range timings {
+		log.Printf("%10s  %3d request(s)  %s", timing.duration, timing.requests, timing.id)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const (
+	restoreToolPaket      = "paket"
+	paketDependenciesFile = "paket.dependencies"
+	dotnetToolsManifest   = ".config/dotnet-tools.json"
+)
+
+// isPaketRepo reports whether the given directory manages its dependencies with Paket.
+func isPaketRepo(dir string) bool {
+	exist, err := pathutil.IsPathExists(filepath.Join(dir, paketDependenciesFile))
+	return err == nil && exist
+}
+
+// paketRestoreCommand bootstraps Paket if needed and returns the paket restore command of the given directory.
+//
+// Paket is looked up in this order:
+// - .paket/paket.exe, run with mono
+// - .paket/paket.bootstrapper.exe, run with mono to download .paket/paket.exe first
+// - the paket dotnet local tool, installed by dotnet tool restore if the repo has a tool manifest
+func paketRestoreCommand(dir string) (restoreCommand, error) {
+	paketExe := filepath.Join(dir, ".paket", "paket.exe")
+	bootstrapperExe := filepath.Join(dir, ".paket", "paket.bootstrapper.exe")
+	toolManifest := filepath.Join(dir, filepath.FromSlash(dotnetToolsManifest))
+
+	if exist, _ := pathutil.IsPathExists(paketExe); exist {
+		return restoreCommand{tool: restoreToolPaket, args: []string{monoPath, paketExe, "restore"}, dir: dir}, nil
+	}
+
+	if exist, _ := pathutil.IsPathExists(bootstrapperExe); exist {
+		log.Printf("Bootstrapping Paket...")
+		if err := runInDir(dir, monoPath, bootstrapperExe); err != nil {
+			return restoreCommand{}, fmt.Errorf("failed to bootstrap Paket: %s", err)
+		}
+		return restoreCommand{tool: restoreToolPaket, args: []string{monoPath, paketExe, "restore"}, dir: dir}, nil
+	}
+
+	if exist, _ := pathutil.IsPathExists(toolManifest); exist {
+		dotnetPth, err := exec.LookPath("dotnet")
+		if err != nil {
+			return restoreCommand{}, fmt.Errorf("found %s, but dotnet is not found on PATH: %s", dotnetToolsManifest, err)
+		}
+		log.Printf("Restoring dotnet tools...")
+		if err := runInDir(dir, dotnetPth, "tool", "restore"); err != nil {
+			return restoreCommand{}, fmt.Errorf("failed to restore dotnet tools: %s", err)
+		}
+		return restoreCommand{tool: restoreToolPaket, args: []string{dotnetPth, "paket", "restore"}, dir: dir}, nil
+	}
+
+	return restoreCommand{}, fmt.Errorf("no .paket/paket.exe, .paket/paket.bootstrapper.exe or %s found in %s", dotnetToolsManifest, dir)
+}
+
+// runInDir runs the given command in the given directory with the standard outputs.
+func runInDir(dir, name string, args ...string) error {
+	cmd := command.NewWithStandardOuts(name, args...).SetDir(dir)
+	log.Donef("$ %s", cmd.PrintableCommandArgs())
+	return cmd.Run()
+}
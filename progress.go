@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// progressLogInterval is the minimum time between two progress lines, downloads finishing sooner print no progress.
+const progressLogInterval = 2 * time.Second
+
+// progressReader logs the progress of the reads from the wrapped reader, at most once per progressLogInterval.
+type progressReader struct {
+	reader io.Reader
+	// read is the number of bytes transferred so far, including the ones before a resumed download.
+	read int64
+	// total is the expected number of bytes, or a negative value if unknown.
+	total   int64
+	lastLog time.Time
+}
+
+func newProgressReader(reader io.Reader, offset, total int64) *progressReader {
+	return &progressReader{reader: reader, read: offset, total: total, lastLog: time.Now()}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+
+	if now := time.Now(); now.Sub(r.lastLog) >= progressLogInterval {
+		r.lastLog = now
+		if r.total > 0 {
+			log.Printf("Downloaded %.1f MB of %.1f MB (%d%%)", megabytes(r.read), megabytes(r.total), r.read*100/r.total)
+		} else {
+			log.Printf("Downloaded %.1f MB", megabytes(r.read))
+		}
+	}
+	return n, err
+}
+
+func megabytes(bytes int64) float64 {
+	return float64(bytes) / (1024 * 1024)
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/retry"
+)
+
+const monoMSBuildPath = "/Library/Frameworks/Mono.framework/Versions/Current/Commands/msbuild"
+
+var errorCodePattern = regexp.MustCompile(`\bNU\d{4}\b`)
+
+// restoreCommand is a restore command and the name of the tool it runs.
+type restoreCommand struct {
+	tool string
+	args []string
+	// dir is the working directory of the command, the current directory is used if empty.
+	dir string
+}
+
+// restoreSources returns the package sources passed to the restore.
+// The mirror source is listed first and the public nuget.org feed second, if the fallback is enabled,
+// followed by the additional sources.
+func restoreSources(mirrorSource string, fallbackToPublic bool, additionalSources []string) []string {
+	var sources []string
+	if mirrorSource != "" {
+		sources = append(sources, mirrorSource)
+		if fallbackToPublic {
+			sources = append(sources, publicNuGetSource)
+		}
+	}
+	return append(sources, additionalSources...)
+}
+
+// sourceArgs returns the source args of the restore command, sourceFlag is -Source for nuget and --source for dotnet.
+// The source args replace the package sources of the NuGet.Config files.
+func sourceArgs(sourceFlag string, sources []string) []string {
+	var args []string
+	for _, source := range sources {
+		args = append(args, sourceFlag, source)
+	}
+	return args
+}
+
+// parseMSBuildProperties parses the newline separated Name=Value pairs into /p:Name=Value args.
+func parseMSBuildProperties(properties string) ([]string, error) {
+	var args []string
+	for _, line := range strings.Split(properties, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if idx := strings.Index(line, "="); idx < 1 {
+			return nil, fmt.Errorf("invalid MSBuild property (%s), expected Name=Value", line)
+		}
+		args = append(args, "/p:"+line)
+	}
+	return args, nil
+}
+
+// englishOutputEnvs make nuget.exe (NUGET_CLI_LANGUAGE), dotnet (DOTNET_CLI_UI_LANGUAGE), msbuild and Mono (the locale)
+// print their messages in English, regardless of the locale of the machine.
+var englishOutputEnvs = []string{
+	"LANG=en_US.UTF-8",
+	"LC_ALL=en_US.UTF-8",
+	"NUGET_CLI_LANGUAGE=en-us",
+	"DOTNET_CLI_UI_LANGUAGE=en-us",
+}
+
+// sensitiveFlags are the command line flags whose value is masked in the printed commands, matched case insensitively.
+var sensitiveFlags = []string{"-Password", "-ApiKey", "-Username", "--password", "--api-key", "--username"}
+
+// maskedValue replaces the value of a sensitive flag in the printed commands.
+const maskedValue = "***"
+
+// printableRestoreArgs returns the printable form of the given command args, with the value of every sensitive flag masked.
+// The args themselves are not modified, the command still receives the real values.
+func printableRestoreArgs(cmdArgs []string) string {
+	masked := append([]string{}, cmdArgs...)
+	for i := 0; i < len(masked)-1; i++ {
+		for _, flag := range sensitiveFlags {
+			if strings.EqualFold(masked[i], flag) {
+				masked[i+1] = maskedValue
+				i++
+				break
+			}
+		}
+	}
+	return command.PrintableCommandArgs(false, masked)
+}
+
+// splitArgs splits the given command line into arguments like a POSIX shell does:
+// single quotes keep everything literal, double quotes keep the spaces and allow backslash escapes,
+// and a backslash outside of quotes escapes the next character.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in: %s", quote, line)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in: %s", line)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// lookPath returns the path of the given executable on the PATH, or the fallback path if it is not on the PATH.
+func lookPath(name, fallbackPth string) (string, error) {
+	if pth, err := exec.LookPath(name); err == nil {
+		return pth, nil
+	}
+	if _, err := exec.LookPath(fallbackPth); err != nil {
+		return "", fmt.Errorf("%s is not found on PATH nor at %s", name, fallbackPth)
+	}
+	return fallbackPth, nil
+}
+
+// msbuildExecutable returns the msbuild of the msbuild_path input, which is either the msbuild executable
+// or the directory containing it (as passed to nuget restore -MSBuildPath). The msbuild on the PATH (or the Mono one) is used if it is not set.
+func msbuildExecutable(msbuildPath string) (string, error) {
+	if msbuildPath == "" {
+		return lookPath("msbuild", monoMSBuildPath)
+	}
+
+	pth := msbuildPath
+	if info, err := os.Stat(pth); err == nil && info.IsDir() {
+		pth = filepath.Join(pth, "msbuild")
+	}
+	if _, err := exec.LookPath(pth); err != nil {
+		return "", fmt.Errorf("msbuild is not found at msbuild_path (%s): %s", msbuildPath, err)
+	}
+	return pth, nil
+}
+
+// buildRestoreCommands returns the restore commands of the configured restore tool, nuGetCmdArgs invokes NuGet.
+//
+// - nuget runs nuget restore.
+// - both runs nuget restore for the packages.config projects first, then dotnet restore for the SDK-style projects.
+// - msbuild runs the Restore target of the solution, for solutions whose custom targets are only restored by MSBuild.
+func buildRestoreCommands(configs ConfigsModel, nuGetCmdArgs []string) ([]restoreCommand, error) {
+	additionalSources, err := parseSourceList(configs.NuGetSources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nuget_sources: %s", err)
+	}
+	sources := restoreSources(configs.MirrorSource, configs.FallbackToPublic, additionalSources)
+
+	if configs.RestoreTool == restoreToolMSBuild {
+		msbuildPth, err := msbuildExecutable(configs.MSBuildPath)
+		if err != nil {
+			return nil, fmt.Errorf("restore_tool is set to %s, but %s", restoreToolMSBuild, err)
+		}
+		props, err := parseMSBuildProperties(configs.MSBuildRestoreProps)
+		if err != nil {
+			return nil, err
+		}
+
+		args := []string{msbuildPth, "/t:Restore", configs.XamarinSolution}
+		if len(sources) > 0 {
+			// Semicolons separate the properties on the command line, so the sources are joined with an escaped one.
+			args = append(args, "/p:RestoreSources="+strings.Join(sources, "%3B"))
+		}
+		if configs.RestoreOutputDir != "" {
+			args = append(args, "/p:RestoreOutputPath="+configs.RestoreOutputDir)
+		}
+		if configs.DeterministicRestore {
+			args = append(args, "/p:RestoreDisableParallel=true")
+		}
+		if configs.NuGetConfigFile != "" {
+			args = append(args, "/p:RestoreConfigFile="+configs.NuGetConfigFile)
+		}
+		if configs.UseLockFile {
+			args = append(args, "/p:RestorePackagesWithLockFile=true")
+		}
+		if configs.LockedMode {
+			args = append(args, "/p:RestoreLockedMode=true")
+		}
+		args = append(args, props...)
+		return []restoreCommand{{tool: restoreToolMSBuild, args: args}}, nil
+	}
+
+	additionalArgs, err := splitArgs(configs.AdditionalArgs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid additional_args: %s", err)
+	}
+
+	if configs.RestoreTool == restoreToolDotnet {
+		dotnetArgs, err := dotnetRestoreArgs(configs, sources)
+		if err != nil {
+			return nil, err
+		}
+		dotnetArgs = append(dotnetArgs, additionalArgs...)
+		return []restoreCommand{{tool: restoreToolDotnet, args: dotnetArgs}}, nil
+	}
+
+	nuGetArgs := append(append([]string{}, nuGetCmdArgs...), "restore", configs.XamarinSolution)
+	nuGetArgs = append(nuGetArgs, sourceArgs("-Source", sources)...)
+	if configs.DeterministicRestore {
+		nuGetArgs = append(nuGetArgs, "-DisableParallelProcessing")
+	}
+	if configs.NuGetConfigFile != "" {
+		nuGetArgs = append(nuGetArgs, "-ConfigFile", configs.NuGetConfigFile)
+	}
+	if configs.PackagesDirectory != "" {
+		nuGetArgs = withPackagesDirectory(nuGetArgs, configs.PackagesDirectory)
+	}
+	if configs.SolutionDirectory != "" {
+		nuGetArgs = append(nuGetArgs, "-SolutionDirectory", configs.SolutionDirectory)
+	}
+	if configs.NoCache {
+		nuGetArgs = append(nuGetArgs, "-NoCache")
+	}
+	if configs.NoHTTPCache {
+		nuGetArgs = append(nuGetArgs, "-NoHttpCache")
+	}
+	if configs.MSBuildPath != "" {
+		nuGetArgs = append(nuGetArgs, "-MSBuildPath", configs.MSBuildPath)
+	}
+	if configs.MSBuildVersion != "" {
+		nuGetArgs = append(nuGetArgs, "-MSBuildVersion", configs.MSBuildVersion)
+	}
+	if configs.Verbosity != "" {
+		nuGetArgs = append(nuGetArgs, "-Verbosity", configs.Verbosity)
+	}
+	if configs.UseLockFile {
+		nuGetArgs = append(nuGetArgs, "-UseLockFile")
+	}
+	if configs.LockedMode {
+		nuGetArgs = append(nuGetArgs, "-LockedMode")
+	}
+	nuGetArgs = append(nuGetArgs, additionalArgs...)
+	cmds := []restoreCommand{{tool: restoreToolNuGet, args: nuGetArgs}}
+
+	if configs.RestoreTool == restoreToolBoth {
+		dotnetArgs, err := dotnetRestoreArgs(configs, sources)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, restoreCommand{tool: restoreToolDotnet, args: dotnetArgs})
+	}
+	return cmds, nil
+}
+
+// dotnetRestoreArgs returns the dotnet restore command args of the solution, shared by the dotnet and both restore tools.
+func dotnetRestoreArgs(configs ConfigsModel, sources []string) ([]string, error) {
+	dotnetPth, err := exec.LookPath("dotnet")
+	if err != nil {
+		return nil, fmt.Errorf("restore_tool is set to %s, but dotnet is not found on PATH: %s", configs.RestoreTool, err)
+	}
+	dotnetArgs := append([]string{dotnetPth, "restore", configs.XamarinSolution}, sourceArgs("--source", sources)...)
+	if configs.RestoreOutputDir != "" {
+		dotnetArgs = append(dotnetArgs, "-p:RestoreOutputPath="+configs.RestoreOutputDir)
+	}
+	if configs.DeterministicRestore {
+		dotnetArgs = append(dotnetArgs, "--disable-parallel")
+	}
+	if configs.NuGetConfigFile != "" {
+		dotnetArgs = append(dotnetArgs, "--configfile", configs.NuGetConfigFile)
+	}
+	if configs.UseLockFile {
+		dotnetArgs = append(dotnetArgs, "--use-lock-file")
+	}
+	if configs.LockedMode {
+		dotnetArgs = append(dotnetArgs, "--locked-mode")
+	}
+	if configs.Verbosity != "" {
+		dotnetArgs = append(dotnetArgs, "--verbosity", configs.Verbosity)
+	}
+	return dotnetArgs, nil
+}
+
+// usesNuGetExe reports whether the given restore tool runs nuget.exe, the dotnet and msbuild restore tools do not.
+func usesNuGetExe(restoreTool string) bool {
+	return restoreTool == restoreToolNuGet || restoreTool == restoreToolBoth
+}
+
+// prepareRestoreOutputDir resolves the restore output dir relative to the solution's directory and creates it if needed.
+func prepareRestoreOutputDir(dir, solutionDir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(solutionDir, dir)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine restore output dir path: %s", err)
+	}
+	if info, err := os.Stat(absDir); err == nil && !info.IsDir() {
+		return "", fmt.Errorf("restore output dir (%s) is not a directory", absDir)
+	}
+	if err := os.MkdirAll(absDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create restore output dir (%s): %s", absDir, err)
+	}
+	return absDir, nil
+}
+
+// checkRestoreOutputTargets checks that every restore target is a single project, as the RestoreOutputPath passed on the command line
+// is shared by all the projects of a solution, whose project.assets.json and generated props would overwrite each other.
+func checkRestoreOutputTargets(targets []restoreTarget) error {
+	for _, target := range targets {
+		if strings.ToLower(filepath.Ext(target.path)) != ".sln" {
+			continue
+		}
+		projects, err := parseSolutionProjects(target.path, projectFileExtensions)
+		if err != nil {
+			return err
+		}
+		if len(projects) > 1 {
+			return fmt.Errorf("restore_output_dir is shared by every project of a solution, but %s has %d projects whose restore outputs would overwrite each other", target.path, len(projects))
+		}
+	}
+	return nil
+}
+
+// withPackagesDirectory returns the nuget restore args with the -PackagesDirectory set to the given directory,
+// replacing the value if the args already set it.
+func withPackagesDirectory(args []string, dir string) []string {
+	updated := append([]string{}, args...)
+	for i := 0; i+1 < len(updated); i++ {
+		if strings.EqualFold(updated[i], "-PackagesDirectory") {
+			updated[i+1] = dir
+			return updated
+		}
+	}
+	return append(updated, "-PackagesDirectory", dir)
+}
+
+// restoreRunOptions configures how a restore command runs.
+type restoreRunOptions struct {
+	// envs are appended to the current environment.
+	envs []string
+	// timeout kills an attempt after the given duration, zero disables it.
+	timeout time.Duration
+	// retryErrorCodes are the NU error codes which make a failed attempt retried, see shouldRetry.
+	retryErrorCodes []string
+	// retryCount is the number of retries after a failed attempt.
+	retryCount uint
+	// retryWait is the wait before the first retry, it doubles with every further retry up to retryMaxWait,
+	// see backoffWait. The wait is randomized by retryJitterPercent.
+	retryWait          time.Duration
+	retryMaxWait       time.Duration
+	retryJitterPercent int
+}
+
+// minRestoreRetryWait is the wait before the first retry if no retry wait is configured.
+const minRestoreRetryWait = time.Second
+
+// backoffWait returns the exponential backoff wait before the given retry (starting from 1):
+// the base wait doubled for every previous retry, capped at the max wait.
+func backoffWait(retry uint, base, max time.Duration) time.Duration {
+	if base <= 0 {
+		base = minRestoreRetryWait
+	}
+	wait := base
+	for i := uint(1); i < retry && wait < max; i++ {
+		wait *= 2
+	}
+	if max > 0 && wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// jitteredWait randomizes the given wait by up to the given percent in both directions,
+// so that parallel builds failing at the same time do not retry in lockstep.
+func jitteredWait(wait time.Duration, percent int) time.Duration {
+	if wait <= 0 || percent <= 0 {
+		return wait
+	}
+	delta := float64(wait) * float64(percent) / 100
+	return wait + time.Duration(delta*(2*rand.Float64()-1))
+}
+
+// parseErrorCodes parses a comma or newline separated list of NU error codes.
+func parseErrorCodes(list string) []string {
+	var codes []string
+	for _, code := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' || r == ' ' }) {
+		codes = append(codes, strings.ToUpper(strings.TrimSpace(code)))
+	}
+	return codes
+}
+
+// shouldRetry decides whether a failed attempt with the given output is retried.
+// Without retry error codes every failure is retried. Otherwise a failure is retried if its output
+// contains any of the retry error codes, or it contains no NU error code at all (like a network error).
+// A failure with only other NU error codes is deterministic and not retried.
+func shouldRetry(output string, retryErrorCodes []string) bool {
+	if len(retryErrorCodes) == 0 {
+		return true
+	}
+
+	codes := errorCodePattern.FindAllString(output, -1)
+	if len(codes) == 0 {
+		return true
+	}
+	for _, code := range codes {
+		for _, retryCode := range retryErrorCodes {
+			if code == retryCode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runRestoreCommand runs the given restore command.
+// The combined output of the last attempt is returned.
+func runRestoreCommand(restoreCmd restoreCommand, opts restoreRunOptions) (string, error) {
+	cmdArgs := restoreCmd.args
+	var output bytes.Buffer
+	var finalErr error
+	// The wait is applied in the action instead of retry.Wait, so that every retry gets a new jitter.
+	err := retry.Times(opts.retryCount).Try(func(attempt uint) error {
+		if attempt > 0 {
+			wait := jitteredWait(backoffWait(attempt, opts.retryWait, opts.retryMaxWait), opts.retryJitterPercent)
+			log.Warnf("Attempt %d/%d failed, retrying in %s...", attempt, opts.retryCount+1, wait.Round(time.Millisecond))
+			time.Sleep(wait)
+		}
+
+		log.Donef("$ %s", printableRestoreArgs(cmdArgs))
+
+		output.Reset()
+		execCmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+		if opts.timeout > 0 {
+			// The restore runs in its own process group, so a timeout kills the processes it started (like msbuild nodes) as well.
+			// Without a timeout it stays in the step's group, so the signals of the build (like an abort) reach it.
+			execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		}
+		cmd := command.NewWithCmd(execCmd)
+		cmd.SetStdout(io.MultiWriter(os.Stdout, &output))
+		cmd.SetStderr(io.MultiWriter(os.Stderr, &output))
+		if len(opts.envs) > 0 {
+			cmd.AppendEnvs(opts.envs...)
+		}
+		if restoreCmd.dir != "" {
+			cmd.SetDir(restoreCmd.dir)
+		}
+
+		if err := runWithTimeout(execCmd, opts.timeout, attempt < opts.retryCount); err != nil {
+			if !shouldRetry(output.String(), opts.retryErrorCodes) {
+				log.Warnf("Restore failed with an error code which is not retried")
+				// Returning nil stops the retry loop, the error is reported through finalErr.
+				finalErr = err
+				return nil
+			}
+			if attempt < opts.retryCount {
+				log.Warnf("Restore failed: %s", err)
+			}
+			return err
+		}
+		return nil
+	})
+	if finalErr != nil {
+		return output.String(), finalErr
+	}
+	return output.String(), err
+}
+
+// errRestoreTimeout is returned by runWithTimeout if the command was killed because it exceeded its timeout.
+var errRestoreTimeout = errors.New("restore timed out")
+
+// runWithTimeout runs the given command and kills it if it exceeds the timeout. A zero timeout disables it.
+// With a timeout the command has to be started in its own process group (Setpgid), the whole group is killed. The retrying flag only affects the log of the timeout.
+func runWithTimeout(execCmd *exec.Cmd, timeout time.Duration, retrying bool) error {
+	if err := execCmd.Start(); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return execCmd.Wait()
+	}
+
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		if retrying {
+			log.Warnf("Restore attempt exceeded %ds, killing and retrying", int(timeout.Seconds()))
+		} else {
+			log.Warnf("Restore attempt exceeded %ds, killing it", int(timeout.Seconds()))
+		}
+		if err := syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL); err != nil {
+			log.Warnf("Failed to kill the restore process group: %s", err)
+		}
+	})
+	err := execCmd.Wait()
+	timer.Stop()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("%w after %s", errRestoreTimeout, timeout)
+	}
+	return err
+}
+
+// printDependencyTree prints the package dependency tree of the solution with dotnet list package.
+// It is only available after a dotnet restore, errors are reported as warnings.
+func printDependencyTree(restoreCmds []restoreCommand, solution string) {
+	dotnetPth := ""
+	for _, restoreCmd := range restoreCmds {
+		if restoreCmd.tool == restoreToolDotnet {
+			dotnetPth = restoreCmd.args[0]
+		}
+	}
+	if dotnetPth == "" {
+		log.Warnf("The dependency tree can only be printed after a dotnet restore, skipping")
+		return
+	}
+
+	cmd := command.NewWithStandardOuts(dotnetPth, "list", solution, "package", "--include-transitive")
+	log.Donef("$ %s", cmd.PrintableCommandArgs())
+	if err := cmd.Run(); err != nil {
+		log.Warnf("Failed to print dependency tree: %s", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunRestoreCommandRetries(t *testing.T) {
+	tests := []struct {
+		name            string
+		failures        int
+		output          string
+		retryCount      uint
+		retryErrorCodes []string
+		wantAttempts    int
+		wantErr         bool
+	}{
+		{name: "no retry", failures: 5, retryCount: 0, wantAttempts: 1, wantErr: true},
+		{name: "always failing", failures: 5, retryCount: 2, wantAttempts: 3, wantErr: true},
+		{name: "succeeds on a retry", failures: 2, retryCount: 3, wantAttempts: 3, wantErr: false},
+		{name: "succeeds at first", failures: 0, retryCount: 3, wantAttempts: 1, wantErr: false},
+		{name: "error code not retried", failures: 5, output: "error NU1101: Unable to find package", retryCount: 3, retryErrorCodes: []string{"NU1301"}, wantAttempts: 1, wantErr: true},
+		{name: "error code retried", failures: 5, output: "error NU1301: Unable to load the service index", retryCount: 2, retryErrorCodes: []string{"NU1301"}, wantAttempts: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attemptsPth := filepath.Join(t.TempDir(), "attempts")
+			// Every attempt appends a line to the attempts file, the first failures attempts fail.
+			script := fmt.Sprintf(`echo attempt >> "%s"; if [ "$(wc -l < "%s")" -le %d ]; then echo "%s"; exit 1; fi`,
+				attemptsPth, attemptsPth, tt.failures, tt.output)
+
+			_, err := runRestoreCommand(restoreCommand{args: []string{"sh", "-c", script}}, restoreRunOptions{
+				retryCount:      tt.retryCount,
+				retryErrorCodes: tt.retryErrorCodes,
+				retryWait:       time.Millisecond,
+				retryMaxWait:    time.Millisecond,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runRestoreCommand() error = %v, want error: %t", err, tt.wantErr)
+			}
+
+			content, err := ioutil.ReadFile(attemptsPth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attempts := strings.Count(string(content), "attempt"); attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestCheckRestoreOutputTargets(t *testing.T) {
+	dir := t.TempDir()
+	project := `Project("{9A19103F-16F7-4668-BE54-9A1E7A4F7556}") = "%s", "%s\%s.csproj", "{00000000-0000-0000-0000-000000000000}"` + "\n"
+	singlePth := filepath.Join(dir, "Single.sln")
+	if err := ioutil.WriteFile(singlePth, []byte(fmt.Sprintf(project, "App", "App", "App")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	multiPth := filepath.Join(dir, "Multi.sln")
+	if err := ioutil.WriteFile(multiPth, []byte(fmt.Sprintf(project, "App", "App", "App")+fmt.Sprintf(project, "Lib", "Lib", "Lib")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		targets []restoreTarget
+		wantErr bool
+	}{
+		{name: "single project solution", targets: []restoreTarget{{path: singlePth}}},
+		{name: "project of a multi project solution", targets: []restoreTarget{{path: filepath.Join(dir, "Lib", "Lib.csproj"), solutionDir: dir}}},
+		{name: "multi project solution", targets: []restoreTarget{{path: singlePth}, {path: multiPth}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkRestoreOutputTargets(tt.targets); (err != nil) != tt.wantErr {
+				t.Errorf("checkRestoreOutputTargets() error = %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMSBuildExecutable(t *testing.T) {
+	dir := t.TempDir()
+	msbuildPth := filepath.Join(dir, "msbuild")
+	if err := ioutil.WriteFile(msbuildPth, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	emptyDir := t.TempDir()
+
+	tests := []struct {
+		name        string
+		msbuildPath string
+		want        string
+		wantErr     bool
+	}{
+		{name: "directory", msbuildPath: dir, want: msbuildPth},
+		{name: "executable", msbuildPath: msbuildPth, want: msbuildPth},
+		{name: "directory without msbuild", msbuildPath: emptyDir, wantErr: true},
+		{name: "missing", msbuildPath: filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := msbuildExecutable(tt.msbuildPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("msbuildExecutable() error = %v, want error: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("msbuildExecutable() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRestoreCommandsVerbosity(t *testing.T) {
+	binDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(binDir, "dotnet"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+
+	for restoreTool, wantCmds := range map[string]int{restoreToolDotnet: 1, restoreToolBoth: 2} {
+		t.Run(restoreTool, func(t *testing.T) {
+			cmds, err := buildRestoreCommands(ConfigsModel{
+				XamarinSolution: "App.sln",
+				RestoreTool:     restoreTool,
+				Verbosity:       "detailed",
+			}, []string{"mono", "nuget.exe"})
+			if err != nil {
+				t.Fatalf("buildRestoreCommands() error = %s", err)
+			}
+			if len(cmds) != wantCmds {
+				t.Fatalf("buildRestoreCommands() returned %d commands, want %d", len(cmds), wantCmds)
+			}
+			for _, cmd := range cmds {
+				want := "--verbosity detailed"
+				if cmd.tool == restoreToolNuGet {
+					want = "-Verbosity detailed"
+				}
+				if args := strings.Join(cmd.args, " "); !strings.Contains(args, want) {
+					t.Errorf("%s restore args = %s, want %s", cmd.tool, args, want)
+				}
+			}
+		})
+	}
+}
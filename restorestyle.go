@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// projectFileExtensions are the project file types scanned for PackageReference items.
+var projectFileExtensions = []string{".csproj", ".fsproj", ".vbproj"}
+
+// restoreStyles lists the projects of each package management style found under a directory.
+type restoreStyles struct {
+	packagesConfig   []string
+	packageReference []string
+}
+
+func (s restoreStyles) mixed() bool {
+	return len(s.packagesConfig) > 0 && len(s.packageReference) > 0
+}
+
+// scanRestoreStyles walks the given directory and collects the packages.config files
+// and the project files with PackageReference items. The packages folders are skipped.
+func scanRestoreStyles(basePth string) (restoreStyles, error) {
+	var styles restoreStyles
+	if err := filepath.Walk(basePth, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			if f.Name() == "packages" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if f.Name() == packagesConfigFile {
+			styles.packagesConfig = append(styles.packagesConfig, pth)
+			return nil
+		}
+		if !isRestorable(pth, projectFileExtensions) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return fmt.Errorf("failed to read (%s): %s", pth, err)
+		}
+		if bytes.Contains(content, []byte("<PackageReference")) {
+			styles.packageReference = append(styles.packageReference, pth)
+		}
+		return nil
+	}); err != nil {
+		return restoreStyles{}, fmt.Errorf("failed to scan the restore styles of (%s): %s", basePth, err)
+	}
+	return styles, nil
+}
+
+// mixedRestoreStyleMessage describes a solution mixing packages.config and PackageReference projects, with the ways to restore it.
+func mixedRestoreStyleMessage(styles restoreStyles) string {
+	return fmt.Sprintf("The solution mixes %s (%s) and PackageReference (%s) projects, nuget restore may skip the PackageReference ones. "+
+		"Set restore_tool to %s to restore them with dotnet as well, or set msbuild_path to the MSBuild nuget should evaluate them with.",
+		packagesConfigFile, strings.Join(styles.packagesConfig, ", "), strings.Join(styles.packageReference, ", "), restoreToolBoth)
+}
+
+// resolveAutoRestoreTool picks the restore tool of the auto restore_tool from the package management style of the solutions:
+// dotnet for PackageReference only solutions, both for mixed ones and nuget otherwise.
+// The nuget restore tool is used if dotnet would be required, but it is not found on the PATH.
+func resolveAutoRestoreTool(solutions []string) (string, error) {
+	var styles restoreStyles
+	for _, solution := range solutions {
+		solutionStyles, err := scanRestoreStyles(solutionDirOf(solution))
+		if err != nil {
+			return "", err
+		}
+		styles.packagesConfig = append(styles.packagesConfig, solutionStyles.packagesConfig...)
+		styles.packageReference = append(styles.packageReference, solutionStyles.packageReference...)
+	}
+
+	restoreTool := restoreToolNuGet
+	switch {
+	case styles.mixed():
+		restoreTool = restoreToolBoth
+	case len(styles.packageReference) > 0:
+		restoreTool = restoreToolDotnet
+	}
+	if restoreTool != restoreToolNuGet {
+		if _, err := exec.LookPath("dotnet"); err != nil {
+			log.Warnf("Found PackageReference projects, but dotnet is not found on PATH, restoring with %s", restoreToolNuGet)
+			return restoreToolNuGet, nil
+		}
+	}
+	return restoreTool, nil
+}
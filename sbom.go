@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const packagesConfigFile = "packages.config"
+
+// SBOM is a minimal CycloneDX style bill of materials of the restored packages.
+//
+// Only the bomFormat, specVersion, version and components fields are written, every component is a library with:
+// - name: the package id
+// - version: the package version
+// - purl: pkg:nuget/<id>@<version>
+// - externalReferences: a distribution reference to the feed the package was downloaded from, if it is known
+type SBOM struct {
+	BOMFormat   string          `json:"bomFormat"`
+	SpecVersion string          `json:"specVersion"`
+	Version     int             `json:"version"`
+	Components  []SBOMComponent `json:"components"`
+}
+
+// SBOMComponent is a package in the SBOM.
+type SBOMComponent struct {
+	Type               string              `json:"type"`
+	Name               string              `json:"name"`
+	Version            string              `json:"version"`
+	PURL               string              `json:"purl"`
+	ExternalReferences []SBOMExternalRefer `json:"externalReferences,omitempty"`
+}
+
+// SBOMExternalRefer is a link of an SBOM component.
+type SBOMExternalRefer struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type packagesConfig struct {
+	Packages []struct {
+		ID      string `xml:"id,attr"`
+		Version string `xml:"version,attr"`
+	} `xml:"package"`
+}
+
+type packagesLock struct {
+	Dependencies map[string]map[string]struct {
+		Type     string `json:"type"`
+		Resolved string `json:"resolved"`
+	} `json:"dependencies"`
+}
+
+type nupkgMetadata struct {
+	Source string `json:"source"`
+}
+
+// packageRef is a package id and version pair.
+type packageRef struct {
+	id      string
+	version string
+}
+
+// parsePackagesConfig returns the packages of a packages.config file content.
+func parsePackagesConfig(content []byte) ([]packageRef, error) {
+	var config packagesConfig
+	if err := xml.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	var refs []packageRef
+	for _, pkg := range config.Packages {
+		if pkg.ID != "" && pkg.Version != "" {
+			refs = append(refs, packageRef{id: pkg.ID, version: pkg.Version})
+		}
+	}
+	return refs, nil
+}
+
+// parsePackagesLock returns the direct and transitive packages of a packages.lock.json file content.
+// Project references are skipped, they are not packages.
+func parsePackagesLock(content []byte) ([]packageRef, error) {
+	var lock packagesLock
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+	var refs []packageRef
+	for _, dependencies := range lock.Dependencies {
+		for id, dependency := range dependencies {
+			if dependency.Resolved == "" || strings.EqualFold(dependency.Type, "Project") {
+				continue
+			}
+			refs = append(refs, packageRef{id: id, version: dependency.Resolved})
+		}
+	}
+	return refs, nil
+}
+
+// collectPackageRefs returns the packages referenced by the packages.config and packages.lock.json files under the given base path.
+func collectPackageRefs(basePth string) ([]packageRef, error) {
+	var refs []packageRef
+	if err := filepath.Walk(basePth, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+
+		var parse func([]byte) ([]packageRef, error)
+		switch f.Name() {
+		case packagesConfigFile:
+			parse = parsePackagesConfig
+		case nuGetLockFile:
+			parse = parsePackagesLock
+		default:
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return fmt.Errorf("failed to read (%s): %s", pth, err)
+		}
+		fileRefs, err := parse(content)
+		if err != nil {
+			return fmt.Errorf("failed to parse (%s): %s", pth, err)
+		}
+		refs = append(refs, fileRefs...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// packageSource returns the feed the package was downloaded from, read from the .nupkg.metadata file of the global packages folder.
+// Returns an empty string if the source is unknown.
+func packageSource(globalPackagesDir string, ref packageRef) string {
+	pth := filepath.Join(globalPackagesDir, strings.ToLower(ref.id), strings.ToLower(ref.version), ".nupkg.metadata")
+	content, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return ""
+	}
+	var metadata nupkgMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return ""
+	}
+	return metadata.Source
+}
+
+// buildSBOM returns the SBOM of the packages referenced under the given base paths.
+// The components are deduplicated and sorted by id and version.
+func buildSBOM(basePths []string, globalPackagesDir string) (SBOM, error) {
+	var refs []packageRef
+	for _, basePth := range basePths {
+		baseRefs, err := collectPackageRefs(basePth)
+		if err != nil {
+			return SBOM{}, err
+		}
+		refs = append(refs, baseRefs...)
+	}
+
+	seen := map[string]bool{}
+	components := []SBOMComponent{}
+	for _, ref := range refs {
+		key := strings.ToLower(ref.id + "@" + ref.version)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		component := SBOMComponent{
+			Type:    "library",
+			Name:    ref.id,
+			Version: ref.version,
+			PURL:    fmt.Sprintf("pkg:nuget/%s@%s", ref.id, ref.version),
+		}
+		if source := packageSource(globalPackagesDir, ref); source != "" {
+			component.ExternalReferences = []SBOMExternalRefer{{Type: "distribution", URL: source}}
+		}
+		components = append(components, component)
+	}
+	sort.Slice(components, func(i, j int) bool {
+		if a, b := strings.ToLower(components[i].Name), strings.ToLower(components[j].Name); a != b {
+			return a < b
+		}
+		return components[i].Version < components[j].Version
+	})
+
+	return SBOM{BOMFormat: "CycloneDX", SpecVersion: "1.4", Version: 1, Components: components}, nil
+}
+
+// writeSBOM writes the SBOM of the packages referenced under the given base paths to the given JSON file.
+func writeSBOM(pth string, basePths []string, globalPackagesDir string) (int, error) {
+	sbom, err := buildSBOM(basePths, globalPackagesDir)
+	if err != nil {
+		return 0, err
+	}
+
+	content, err := json.MarshalIndent(sbom, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("failed to serialize SBOM: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create (%s): %s", filepath.Dir(pth), err)
+	}
+	if err := ioutil.WriteFile(pth, content, 0644); err != nil {
+		return 0, fmt.Errorf("failed to write (%s): %s", pth, err)
+	}
+	return len(sbom.Components), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// defaultRestorableExtensions are the file types nuget, dotnet and msbuild can restore.
+	defaultRestorableExtensions = ".sln,.csproj,.fsproj,.vbproj,.slnf"
+	sourceDirEnvKey             = "BITRISE_SOURCE_DIR"
+)
+
+// parseRestorableExtensions parses a comma or newline separated list of file extensions, like .sln.
+func parseRestorableExtensions(list string) ([]string, error) {
+	var exts []string
+	for _, field := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' }) {
+		ext := strings.TrimSpace(field)
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") || len(ext) == 1 {
+			return nil, fmt.Errorf("invalid restorable extension (%s), it has to start with a dot, like .sln", ext)
+		}
+		exts = append(exts, strings.ToLower(ext))
+	}
+	if len(exts) == 0 {
+		return nil, fmt.Errorf("no restorable extension set")
+	}
+	return exts, nil
+}
+
+// isRestorable reports whether the given file has one of the given extensions.
+func isRestorable(pth string, exts []string) bool {
+	ext := strings.ToLower(filepath.Ext(pth))
+	for _, restorable := range exts {
+		if ext == restorable {
+			return true
+		}
+	}
+	return false
+}
+
+// isSolutionPattern reports whether the given solution input is a glob pattern.
+func isSolutionPattern(input string) bool {
+	return strings.ContainsAny(input, "*?[")
+}
+
+// resolveSolutionList resolves every comma or newline separated path or glob pattern of the solution input,
+// see resolveSolutions. Each solution is returned once, in the order of the input.
+func resolveSolutionList(list string, exts []string) ([]string, error) {
+	var solutions []string
+	seen := map[string]bool{}
+	for _, field := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' }) {
+		input := strings.TrimSpace(field)
+		if input == "" {
+			continue
+		}
+		matches, err := resolveSolutions(input, exts)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				solutions = append(solutions, match)
+			}
+		}
+	}
+	return solutions, nil
+}
+
+// solutionDirOf returns the directory of the given solution, or the solution itself if it is a directory.
+func solutionDirOf(solution string) string {
+	if info, err := os.Stat(solution); err == nil && info.IsDir() {
+		return solution
+	}
+	return filepath.Dir(solution)
+}
+
+// discoverSolution returns the only .sln file under the given root dir, hidden directories are skipped.
+// It fails if there is no or more than one solution, listing the candidates in the latter case.
+func discoverSolution(root string) (string, error) {
+	var candidates []string
+	if err := filepath.Walk(root, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			if pth != root && strings.HasPrefix(f.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.EqualFold(filepath.Ext(pth), ".sln") {
+			candidates = append(candidates, pth)
+		}
+		return nil
+	}); err != nil {
+		return "", fmt.Errorf("failed to search solutions in (%s): %s", root, err)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("no .sln file found in (%s), set xamarin_solution", root)
+	case 1:
+		return candidates[0], nil
+	}
+	sort.Strings(candidates)
+	return "", fmt.Errorf("%d .sln files found in (%s), set xamarin_solution to one of them: %s", len(candidates), root, strings.Join(candidates, ", "))
+}
+
+// resolveSolutions returns the restorable files matching the given solution input, sorted.
+// An input without glob meta characters must point to an existing file with a restorable extension or to a directory
+// (nuget restores the solution it finds in it), the matches of a glob pattern without a restorable extension are skipped.
+func resolveSolutions(input string, exts []string) ([]string, error) {
+	if !isSolutionPattern(input) {
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, fmt.Errorf("solution (%s) does not exist: %s", input, err)
+		}
+		if !info.IsDir() && !isRestorable(input, exts) {
+			return nil, fmt.Errorf("xamarin_solution must be a %s file or a solution directory; got %s", strings.Join(exts, ", "), input)
+		}
+		return []string{input}, nil
+	}
+
+	matches, err := filepath.Glob(input)
+	if err != nil {
+		return nil, fmt.Errorf("invalid solution pattern (%s): %s", input, err)
+	}
+	var solutions []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.IsDir() && isRestorable(match, exts) {
+			solutions = append(solutions, match)
+		}
+	}
+	sort.Strings(solutions)
+	return solutions, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+// nuGetConfigNames are the file names of the NuGet.Config files NuGet looks up in a directory.
+var nuGetConfigNames = []string{"nuget.config", "NuGet.config", "NuGet.Config"}
+
+var packageReferenceIncludePattern = regexp.MustCompile(`<PackageReference\s[^>]*?Include\s*=\s*"([^"]+)"`)
+
+// sourceMappingConfig is the package sources and the package source mapping of a NuGet.Config file.
+type sourceMappingConfig struct {
+	PackageSources []nuGetConfigEntry `xml:"packageSources>add"`
+	Mapping        *struct {
+		Sources []struct {
+			Key      string `xml:"key,attr"`
+			Packages []struct {
+				Pattern string `xml:"pattern,attr"`
+			} `xml:"package"`
+		} `xml:"packageSource"`
+	} `xml:"packageSourceMapping"`
+}
+
+// findNuGetConfig returns the NuGet.Config nearest to the given directory, looking up its parent directories as NuGet does.
+// Returns an empty path if there is none.
+func findNuGetConfig(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		for _, name := range nuGetConfigNames {
+			pth := filepath.Join(absDir, name)
+			if exist, err := pathutil.IsPathExists(pth); err != nil {
+				return "", err
+			} else if exist {
+				return pth, nil
+			}
+		}
+		parent := filepath.Dir(absDir)
+		if parent == absDir {
+			return "", nil
+		}
+		absDir = parent
+	}
+}
+
+// matchesPackagePattern reports whether the package id matches a package source mapping pattern,
+// either exactly or by prefix if the pattern ends with *. The match is case insensitive.
+func matchesPackagePattern(id, pattern string) bool {
+	id, pattern = strings.ToLower(id), strings.ToLower(pattern)
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(id, strings.TrimSuffix(pattern, "*"))
+	}
+	return id == pattern
+}
+
+// packageReferenceIDs returns the ids of the PackageReference items of the projects under the given directory, sorted.
+func packageReferenceIDs(dir string) ([]string, error) {
+	found := map[string]bool{}
+	if err := filepath.Walk(dir, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			if f.Name() == "packages" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isRestorable(pth, projectFileExtensions) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return fmt.Errorf("failed to read (%s): %s", pth, err)
+		}
+		for _, match := range packageReferenceIncludePattern.FindAllStringSubmatch(string(content), -1) {
+			found[match[1]] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// validateSourceMapping checks the packageSourceMapping of the given NuGet.Config against the projects under the solution directory:
+// every mapped source has to be defined, every defined source has to be mapped and reachable,
+// and every PackageReference has to match a pattern. All the problems are returned in a single error.
+// The check is skipped if the config has no packageSourceMapping.
+func validateSourceMapping(configPth, solutionDir string, client httpDoer) error {
+	content, err := ioutil.ReadFile(configPth)
+	if err != nil {
+		return fmt.Errorf("failed to read (%s): %s", configPth, err)
+	}
+	var config sourceMappingConfig
+	if err := xml.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("failed to parse (%s): %s", configPth, err)
+	}
+	if config.Mapping == nil {
+		log.Printf("No packageSourceMapping in %s", configPth)
+		return nil
+	}
+
+	var problems []string
+
+	sources := map[string]string{}
+	for _, source := range config.PackageSources {
+		sources[source.Key] = source.Value
+	}
+	mapped := map[string]bool{}
+	var patterns []string
+	var undefined []string
+	for _, source := range config.Mapping.Sources {
+		mapped[source.Key] = true
+		if _, ok := sources[source.Key]; !ok {
+			undefined = append(undefined, source.Key)
+		}
+		for _, pkg := range source.Packages {
+			patterns = append(patterns, pkg.Pattern)
+		}
+	}
+	if len(undefined) > 0 {
+		problems = append(problems, fmt.Sprintf("mapped sources not defined in packageSources: %s", strings.Join(undefined, ", ")))
+	}
+
+	var unmappedSources []string
+	for _, source := range config.PackageSources {
+		if !mapped[source.Key] {
+			unmappedSources = append(unmappedSources, source.Key)
+			continue
+		}
+		if !strings.HasPrefix(source.Value, "http://") && !strings.HasPrefix(source.Value, "https://") {
+			continue
+		}
+		if err := checkConnectivity(client, source.Value); err != nil {
+			problems = append(problems, fmt.Sprintf("source %s: %s", source.Key, err))
+		}
+	}
+	if len(unmappedSources) > 0 {
+		problems = append(problems, fmt.Sprintf("sources without a packageSourceMapping entry, no package is restored from them: %s", strings.Join(unmappedSources, ", ")))
+	}
+
+	ids, err := packageReferenceIDs(solutionDir)
+	if err != nil {
+		return fmt.Errorf("failed to collect the package references of (%s): %s", solutionDir, err)
+	}
+	var unmappedPackages []string
+	for _, id := range ids {
+		matched := false
+		for _, pattern := range patterns {
+			if matchesPackagePattern(id, pattern) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unmappedPackages = append(unmappedPackages, id)
+		}
+	}
+	if len(unmappedPackages) > 0 {
+		problems = append(problems, fmt.Sprintf("packages matching no packageSourceMapping pattern, their restore fails with NU1100: %s", strings.Join(unmappedPackages, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid package source mapping in %s: %s", configPth, strings.Join(problems, "; "))
+	}
+	log.Printf("Package source mapping of %s is valid, %d packages mapped", configPth, len(ids))
+	return nil
+}
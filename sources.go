@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+var (
+	urlUserInfoPattern      = regexp.MustCompile(`(?i)([a-z][a-z0-9+.-]*://)[^/\s@]+@`)
+	secretQueryParamPattern = regexp.MustCompile(`(?i)([?&](?:access_token|token|password|pwd|key|sig)=)[^&\s]+`)
+)
+
+// redactSourceCredentials masks the credentials embedded into the package source URLs of the given text.
+func redactSourceCredentials(text string) string {
+	text = urlUserInfoPattern.ReplaceAllString(text, "${1}[REDACTED]@")
+	return secretQueryParamPattern.ReplaceAllString(text, "${1}[REDACTED]")
+}
+
+// sourcesListCommand returns the command printing the package sources effective in the given directory.
+// The dotnet and msbuild restore tools do not use nuget.exe, dotnet is used for them instead.
+func sourcesListCommand(restoreTool string, nuGetCmdArgs []string) ([]string, error) {
+	if !usesNuGetExe(restoreTool) {
+		dotnetPth, err := exec.LookPath("dotnet")
+		if err != nil {
+			return nil, fmt.Errorf("dotnet is not found on PATH: %s", err)
+		}
+		return []string{dotnetPth, "nuget", "list", "source"}, nil
+	}
+	return append(append([]string{}, nuGetCmdArgs...), "sources", "list"), nil
+}
+
+// logSources prints the package sources effective in the given directory, with the credentials redacted.
+func logSources(restoreTool string, nuGetCmdArgs []string, dir string) error {
+	cmdArgs, err := sourcesListCommand(restoreTool, nuGetCmdArgs)
+	if err != nil {
+		return err
+	}
+	cmd, err := command.NewFromSlice(cmdArgs)
+	if err != nil {
+		return fmt.Errorf("failed to create sources list command: %s", err)
+	}
+	cmd.SetDir(dir)
+
+	log.Donef("$ %s", cmd.PrintableCommandArgs())
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s, output: %s", cmd.PrintableCommandArgs(), err, redactSourceCredentials(out))
+	}
+	log.Printf("%s", redactSourceCredentials(out))
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// StepSummary is the machine readable summary of the step run, written to the summary_output_path.
+type StepSummary struct {
+	NuGetVersion    string   `json:"nuget_version"`
+	Solutions       []string `json:"solutions"`
+	DurationSeconds float64  `json:"restore_duration_seconds"`
+	CachePaths      int      `json:"cache_paths"`
+	Status          string   `json:"status"`
+}
+
+var (
+	// summaryOutputPath is the file where the restore summary is written at the end of the step, if set.
+	summaryOutputPath string
+	// stepSummary is filled in as the step progresses.
+	stepSummary StepSummary
+)
+
+// writeStepSummary writes the step summary with the given status to the summary_output_path, if set.
+func writeStepSummary(status string) {
+	if summaryOutputPath == "" {
+		return
+	}
+
+	stepSummary.Status = status
+	if err := writeSummaryFile(summaryOutputPath, stepSummary); err != nil {
+		log.Warnf("Failed to write restore summary: %s", err)
+	}
+}
+
+func writeSummaryFile(pth string, summary StepSummary) error {
+	content, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize restore summary: %s", err)
+	}
+	if err := ioutil.WriteFile(pth, content, 0644); err != nil {
+		return fmt.Errorf("failed to write (%s): %s", pth, err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+)
+
+const xamarinAndroidFrameworksDir = "/Library/Frameworks/Xamarin.Android.framework/Versions/Current/lib/xamarin.android/xbuild-frameworks/MonoAndroid"
+
+var (
+	targetFrameworkPattern        = regexp.MustCompile(`<TargetFrameworks?>\s*([^<]+?)\s*</TargetFrameworks?>`)
+	targetFrameworkVersionPattern = regexp.MustCompile(`<TargetFrameworkVersion>\s*v?([^<]+?)\s*</TargetFrameworkVersion>`)
+	dotnetMonikerPattern          = regexp.MustCompile(`^(?:net|netcoreapp)(\d+)\.\d+(?:-.+)?$`)
+	netFrameworkMonikerPattern    = regexp.MustCompile(`^net(\d)(\d)(\d?)$`)
+	dotnetSDKVersionPattern       = regexp.MustCompile(`(?m)^(\d+)\.\d+\.\d+\S*\s+\[`)
+)
+
+// projectFileExts are the project file types scanned for target frameworks.
+var projectFileExts = []string{".csproj", ".fsproj", ".vbproj"}
+
+// projectTargetFramework is a target framework of a project.
+type projectTargetFramework struct {
+	project string
+	// moniker is the target framework moniker (like net6.0 or net472) of SDK-style projects.
+	moniker string
+	// version is the TargetFrameworkVersion (like 4.7.2) of legacy projects.
+	version string
+	// android is true for legacy Xamarin.Android projects, whose TargetFrameworkVersion is a MonoAndroid version.
+	android bool
+}
+
+func (f projectTargetFramework) String() string {
+	if f.moniker != "" {
+		return f.moniker
+	}
+	if f.android {
+		return "MonoAndroid v" + f.version
+	}
+	return ".NETFramework v" + f.version
+}
+
+// parseTargetFrameworks parses the target frameworks of the given project file content.
+func parseTargetFrameworks(project, content string) []projectTargetFramework {
+	var frameworks []projectTargetFramework
+	for _, match := range targetFrameworkPattern.FindAllStringSubmatch(content, -1) {
+		for _, moniker := range strings.Split(match[1], ";") {
+			if moniker = strings.TrimSpace(moniker); moniker != "" && !strings.Contains(moniker, "$(") {
+				frameworks = append(frameworks, projectTargetFramework{project: project, moniker: moniker})
+			}
+		}
+	}
+	for _, match := range targetFrameworkVersionPattern.FindAllStringSubmatch(content, -1) {
+		frameworks = append(frameworks, projectTargetFramework{
+			project: project,
+			version: match[1],
+			android: strings.Contains(content, "Xamarin.Android"),
+		})
+	}
+	return frameworks
+}
+
+// installedFrameworks describes the SDKs and targeting packs available on the machine.
+type installedFrameworks struct {
+	dotnetSDKMajors map[int]bool
+	monoLibDir      string
+	androidDir      string
+}
+
+// listDotnetSDKMajors returns the major versions of the installed .NET SDKs.
+func listDotnetSDKMajors() map[int]bool {
+	majors := map[int]bool{}
+	if _, err := exec.LookPath("dotnet"); err != nil {
+		return majors
+	}
+
+	out, err := command.New("dotnet", "--list-sdks").RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		log.Warnf("Failed to list .NET SDKs: %s, output: %s", err, out)
+		return majors
+	}
+	for _, match := range dotnetSDKVersionPattern.FindAllStringSubmatch(out, -1) {
+		if major, err := strconv.Atoi(match[1]); err == nil {
+			majors[major] = true
+		}
+	}
+	return majors
+}
+
+// missingReason returns why the given target framework is not available, or an empty string if it is available.
+// Frameworks which can not be checked are reported as available.
+func (i installedFrameworks) missingReason(framework projectTargetFramework) string {
+	if framework.moniker != "" {
+		moniker := strings.ToLower(framework.moniker)
+		if strings.HasPrefix(moniker, "netstandard") {
+			if len(i.dotnetSDKMajors) == 0 {
+				return "no .NET SDK is installed"
+			}
+			return ""
+		}
+		if match := dotnetMonikerPattern.FindStringSubmatch(moniker); match != nil {
+			required, _ := strconv.Atoi(match[1])
+			for major := range i.dotnetSDKMajors {
+				if major >= required {
+					return ""
+				}
+			}
+			return fmt.Sprintf("no .NET SDK %d or newer is installed", required)
+		}
+		if match := netFrameworkMonikerPattern.FindStringSubmatch(moniker); match != nil {
+			version := match[1] + "." + match[2]
+			if match[3] != "" {
+				version += "." + match[3]
+			}
+			return i.netFrameworkMissingReason(version)
+		}
+		return ""
+	}
+
+	if framework.android {
+		if exist, _ := pathutil.IsDirExists(filepath.Join(i.androidDir, "v"+framework.version)); !exist {
+			return fmt.Sprintf("MonoAndroid v%s is not installed in %s", framework.version, i.androidDir)
+		}
+		return ""
+	}
+	return i.netFrameworkMissingReason(framework.version)
+}
+
+// netFrameworkMissingReason checks whether Mono ships the reference assemblies of the given .NET Framework version.
+func (i installedFrameworks) netFrameworkMissingReason(version string) string {
+	// Xamarin.iOS and other platform projects use their own versioning, only .NET Framework 2-4 versions are checked.
+	if !strings.HasPrefix(version, "4.") && !strings.HasPrefix(version, "3.") && !strings.HasPrefix(version, "2.") {
+		return ""
+	}
+	if exist, _ := pathutil.IsDirExists(filepath.Join(i.monoLibDir, version+"-api")); !exist {
+		return fmt.Sprintf(".NET Framework %s reference assemblies are not installed in %s", version, i.monoLibDir)
+	}
+	return ""
+}
+
+// collectProjectFiles returns the project files found under the given base path.
+func collectProjectFiles(basePth string) ([]string, error) {
+	var projects []string
+	if err := filepath.Walk(basePth, func(pth string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+		for _, ext := range projectFileExts {
+			if strings.EqualFold(filepath.Ext(pth), ext) {
+				projects = append(projects, pth)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to collect project files: %s", err)
+	}
+	return projects, nil
+}
+
+// checkTargetFrameworks warns about every project target framework which is not installed on the machine.
+func checkTargetFrameworks(basePth string) error {
+	projects, err := collectProjectFiles(basePth)
+	if err != nil {
+		return err
+	}
+
+	installed := installedFrameworks{
+		dotnetSDKMajors: listDotnetSDKMajors(),
+		monoLibDir:      filepath.Join(filepath.Dir(filepath.Dir(monoPath)), "lib", "mono"),
+		androidDir:      xamarinAndroidFrameworksDir,
+	}
+
+	mismatches := 0
+	for _, project := range projects {
+		content, err := ioutil.ReadFile(project)
+		if err != nil {
+			return fmt.Errorf("failed to read (%s): %s", project, err)
+		}
+
+		for _, framework := range parseTargetFrameworks(project, string(content)) {
+			if reason := installed.missingReason(framework); reason != "" {
+				log.Warnf("%s targets %s, but %s", project, framework, reason)
+				mismatches++
+			}
+		}
+	}
+
+	if mismatches == 0 {
+		log.Donef("All target frameworks of %d project(s) are installed", len(projects))
+	} else {
+		log.Warnf("%d target framework(s) are not installed, the restore may succeed but the build will likely fail", mismatches)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	testResultDirEnv   = "BITRISE_TEST_RESULT_DIR"
+	testAddonRunName   = "NuGet restore timings"
+	testAddonRunDir    = "nuget-restore-timings"
+	testAddonClassName = "nuget-restore"
+)
+
+// phaseTiming is the duration of a phase of the step, like the NuGet download or the restore.
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name  string          `xml:"name,attr"`
+	Tests int             `xml:"tests,attr"`
+	Time  string          `xml:"time,attr"`
+	Cases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string `xml:"name,attr"`
+	ClassName string `xml:"classname,attr"`
+	Time      string `xml:"time,attr"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// exportToTestAddon writes the phase timings as a JUnit test run into the given test result dir,
+// in the layout the test reports add-on (Deploy to Bitrise.io step) collects: <dir>/<run>/test-info.json and the JUnit XML next to it.
+func exportToTestAddon(resultDir string, phases []phaseTiming) (string, error) {
+	runDir := filepath.Join(resultDir, testAddonRunDir)
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create (%s): %s", runDir, err)
+	}
+
+	var total time.Duration
+	suite := junitTestSuite{Name: testAddonRunName, Tests: len(phases)}
+	for _, phase := range phases {
+		total += phase.duration
+		suite.Cases = append(suite.Cases, junitTestCase{Name: phase.name, ClassName: testAddonClassName, Time: junitSeconds(phase.duration)})
+	}
+	suite.Time = junitSeconds(total)
+
+	report, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize JUnit report: %s", err)
+	}
+	reportPth := filepath.Join(runDir, testAddonRunDir+".xml")
+	if err := ioutil.WriteFile(reportPth, append([]byte(xml.Header), report...), 0644); err != nil {
+		return "", fmt.Errorf("failed to write (%s): %s", reportPth, err)
+	}
+
+	info, err := json.Marshal(map[string]string{"test-name": testAddonRunName})
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize test info: %s", err)
+	}
+	infoPth := filepath.Join(runDir, "test-info.json")
+	if err := ioutil.WriteFile(infoPth, info, 0644); err != nil {
+		return "", fmt.Errorf("failed to write (%s): %s", infoPth, err)
+	}
+	return reportPth, nil
+}